@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultAccessLogFormat   = `{{.Time.Format "2006-01-02T15:04:05.000Z07:00"}} conn={{.ID}} client={{.Client}} sni={{printf "%q" .SNI}} alpn={{printf "%q" .ALPN}} ja3={{.JA3}} frontend={{.Frontend}} backend={{.Backend}} dial={{.DialTime}} duration={{.Duration}} bytes_in={{.BytesIn}} bytes_out={{.BytesOut}} close={{printf "%q" .CloseReason}}`
+	defaultAccessLogMaxFiles = 5
+)
+
+// AccessLog writes one line per proxied connection. Output is stdout,
+// stderr, syslog (local), syslog://host:port (UDP) or a file path. Files are
+// rotated once they reach MaxSize megabytes, keeping MaxFiles old files.
+// Format is a text/template executed against an accessLogEntry.
+type AccessLog struct {
+	Output   string `yaml:"output"`
+	Format   string `yaml:"format"`
+	MaxSize  int    `yaml:"max_size"`
+	MaxFiles int    `yaml:"max_files"`
+}
+
+type accessLogEntry struct {
+	Time        time.Time
+	ID          uint64
+	Client      net.Addr
+	SNI         string
+	ALPN        string
+	JA3         string
+	Frontend    string
+	Backend     string
+	DialTime    time.Duration
+	Duration    time.Duration
+	BytesIn     int64
+	BytesOut    int64
+	CloseReason string
+}
+
+type accessLogger struct {
+	sync.Mutex
+	w    io.Writer
+	tmpl *template.Template
+	buf  bytes.Buffer
+}
+
+func newAccessLogger(conf *AccessLog) (*accessLogger, error) {
+	format := conf.Format
+	if format == "" {
+		format = defaultAccessLogFormat
+	}
+
+	tmpl, err := template.New("access_log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log format: %v", err)
+	}
+
+	var w io.Writer
+	switch {
+	case conf.Output == "" || conf.Output == "stdout":
+		w = os.Stdout
+	case conf.Output == "stderr":
+		w = os.Stderr
+	case conf.Output == "syslog":
+		w, err = syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "tlsmux")
+	case strings.HasPrefix(conf.Output, "syslog://"):
+		w, err = syslog.Dial("udp", strings.TrimPrefix(conf.Output, "syslog://"), syslog.LOG_INFO|syslog.LOG_DAEMON, "tlsmux")
+	default:
+		maxFiles := conf.MaxFiles
+		if maxFiles == 0 {
+			maxFiles = defaultAccessLogMaxFiles
+		}
+		w, err = openRotatingFile(conf.Output, int64(conf.MaxSize)<<20, maxFiles)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %v", err)
+	}
+
+	return &accessLogger{w: w, tmpl: tmpl}, nil
+}
+
+// log writes entry. A nil logger discards it.
+func (l *accessLogger) log(entry *accessLogEntry) error {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.buf.Reset()
+	if err := l.tmpl.Execute(&l.buf, entry); err != nil {
+		return err
+	}
+	if l.buf.Len() == 0 || l.buf.Bytes()[l.buf.Len()-1] != '\n' {
+		l.buf.WriteByte('\n')
+	}
+
+	_, err := l.w.Write(l.buf.Bytes())
+	return err
+}
+
+// rotatingFile renames path to path.1, path.1 to path.2 and so on once it
+// grows beyond maxSize bytes. A maxSize of zero disables rotation.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+// Write is not safe for concurrent use; accessLogger serializes it.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormat(t *testing.T) {
+	entry := &accessLogEntry{
+		Time:        time.Date(2024, 3, 1, 12, 30, 45, 123e6, time.UTC),
+		ID:          42,
+		Client:      tcpAddr("192.0.2.1", 50000),
+		SNI:         "example.com",
+		ALPN:        "h2",
+		JA3:         "ada70206e40642a3e4461f35503241d5",
+		Frontend:    "example.com",
+		Backend:     "10.0.0.1:443",
+		DialTime:    1500 * time.Microsecond,
+		Duration:    2 * time.Second,
+		BytesIn:     517,
+		BytesOut:    4096,
+		CloseReason: "client closed",
+	}
+
+	for _, tt := range []struct {
+		format, want string
+	}{
+		{"", `2024-03-01T12:30:45.123Z conn=42 client=192.0.2.1:50000 sni="example.com" alpn="h2" ja3=ada70206e40642a3e4461f35503241d5 frontend=example.com backend=10.0.0.1:443 dial=1.5ms duration=2s bytes_in=517 bytes_out=4096 close="client closed"` + "\n"},
+		{"{{.ID}} {{.Frontend}}\n", "42 example.com\n"},
+		{"{{.BytesIn}}", "517\n"},
+	} {
+		var buf bytes.Buffer
+		l, err := newAccessLogger(&AccessLog{Format: tt.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.w = &buf
+		if err := l.log(entry); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("format %q wrote %q, want %q", tt.format, buf.String(), tt.want)
+		}
+	}
+
+	if _, err := newAccessLogger(&AccessLog{Format: "{{.Missing"}); err == nil {
+		t.Error("broken template was accepted")
+	}
+	var nilLogger *accessLogger
+	if err := nilLogger.log(entry); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	r, err := openRotatingFile(path, 20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { r.f.Close() }()
+
+	// each line is 10 bytes, so every file holds two
+	for i := 0; i < 7; i++ {
+		if _, err := fmt.Fprintf(r, "line %04d\n", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		path:        "line 0006\n",
+		path + ".1": "line 0004\nline 0005\n",
+		path + ".2": "line 0002\nline 0003\n",
+	} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%v holds %q, want %q", filepath.Base(name), got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than two old files kept: %v", err)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	os.WriteFile(path, []byte(strings.Repeat("x", 15)), 0o644)
+
+	// the existing size counts towards the limit, and without old files
+	// to keep the log starts over
+	r, err := openRotatingFile(path, 20, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { r.f.Close() }()
+	fmt.Fprint(r, "line 0000\n")
+
+	got, _ := os.ReadFile(path)
+	if string(got) != "line 0000\n" {
+		t.Errorf("log holds %q after rotating", got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("old file kept with max_files 0: %v", err)
+	}
+}
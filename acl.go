@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	aclReloadInterval = 10 * time.Second
+)
+
+// ACL restricts which clients may connect. Deny rules are evaluated first; if
+// there are any allow rules, a client must then match one of them. The files
+// hold one address or CIDR per line and are reloaded when they change.
+type ACL struct {
+	Allow     []string `yaml:"allow"`
+	Deny      []string `yaml:"deny"`
+	AllowFile string   `yaml:"allow_file"`
+	DenyFile  string   `yaml:"deny_file"`
+}
+
+type accessRule struct {
+	network *net.IPNet
+	allow   bool
+	source  string
+	hits    uint64
+}
+
+func (r *accessRule) String() string {
+	action := "deny"
+	if r.allow {
+		action = "allow"
+	}
+	return fmt.Sprintf("%s %v (%s)", action, r.network, r.source)
+}
+
+// Hits returns how many connections matched the rule.
+func (r *accessRule) Hits() uint64 {
+	return atomic.LoadUint64(&r.hits)
+}
+
+type accessList struct {
+	sync.RWMutex
+	*ACL
+	name   string
+	allow  []*accessRule
+	deny   []*accessRule
+	mtimes map[string]time.Time
+}
+
+func newAccessList(name string, conf *ACL) (*accessList, error) {
+	a := &accessList{ACL: conf, name: name}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// check returns an error if addr is not allowed. A nil list allows everyone.
+func (a *accessList) check(addr net.Addr) error {
+	if a == nil {
+		return nil
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+
+	for _, rule := range a.deny {
+		if rule.network.Contains(ip) {
+			atomic.AddUint64(&rule.hits, 1)
+			return Forbidden{fmt.Errorf("%v denied by %v rule %v", ip, a.name, rule)}
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return nil
+	}
+
+	for _, rule := range a.allow {
+		if rule.network.Contains(ip) {
+			atomic.AddUint64(&rule.hits, 1)
+			return nil
+		}
+	}
+
+	return Forbidden{fmt.Errorf("%v not allowed by %v", ip, a.name)}
+}
+
+// Rules returns a snapshot of the deny rules followed by the allow rules.
+func (a *accessList) Rules() []*accessRule {
+	a.RLock()
+	defer a.RUnlock()
+	return append(append([]*accessRule{}, a.deny...), a.allow...)
+}
+
+// reload rebuilds the rules from the configuration and list files, carrying
+// hit counters over for rules that did not change.
+func (a *accessList) reload() error {
+	mtimes := make(map[string]time.Time)
+
+	allow, err := a.load(a.Allow, a.AllowFile, true, mtimes)
+	if err != nil {
+		return err
+	}
+
+	deny, err := a.load(a.Deny, a.DenyFile, false, mtimes)
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	previous := make(map[string]*accessRule)
+	for _, rule := range append(a.allow, a.deny...) {
+		previous[rule.String()] = rule
+	}
+	for _, rule := range append(allow, deny...) {
+		if old, ok := previous[rule.String()]; ok {
+			rule.hits = old.Hits()
+		}
+	}
+
+	a.allow, a.deny, a.mtimes = allow, deny, mtimes
+	return nil
+}
+
+func (a *accessList) load(cidrs []string, path string, allow bool, mtimes map[string]time.Time) ([]*accessRule, error) {
+	networks, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %v rule: %v", a.name, err)
+	}
+
+	rules := make([]*accessRule, 0, len(networks))
+	for _, network := range networks {
+		rules = append(rules, &accessRule{network: network, allow: allow, source: "config"})
+	}
+
+	if path == "" {
+		return rules, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	mtimes[path] = info.ModTime()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+
+		networks, err := parseCIDRs([]string{line})
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		rules = append(rules, &accessRule{network: networks[0], allow: allow, source: fmt.Sprintf("%s:%d", path, n)})
+	}
+
+	return rules, scanner.Err()
+}
+
+func (a *accessList) changed() bool {
+	a.RLock()
+	defer a.RUnlock()
+
+	for _, path := range []string{a.AllowFile, a.DenyFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || !info.ModTime().Equal(a.mtimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the list whenever one of its files changes. A list that fails
+// to reload keeps its previous rules.
+func (a *accessList) watch(logger *slog.Logger) {
+	if a.AllowFile == "" && a.DenyFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(aclReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !a.changed() {
+			continue
+		}
+		if err := a.reload(); err != nil {
+			logger.Error("failed to reload access list", "acl", a.name, "err", err)
+			continue
+		}
+		logger.Info("reloaded access list", "acl", a.name)
+	}
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessListDenyBeforeAllow(t *testing.T) {
+	acl, err := newAccessList("test", &ACL{
+		Allow: []string{"10.0.0.0/8", "2001:db8::/32"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false, // denied although the allow list matches
+		"192.0.2.1":   false, // not on the allow list
+		"2001:db8::1": true,
+	} {
+		err := acl.check(tcpAddr(ip, 1234))
+		if allowed && err != nil {
+			t.Errorf("%v was refused: %v", ip, err)
+		}
+		if _, ok := err.(Forbidden); !allowed && !ok {
+			t.Errorf("%v got %v, want Forbidden", ip, err)
+		}
+	}
+
+	// without allow rules, anything not denied is allowed
+	denyOnly, err := newAccessList("test", &ACL{Deny: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := denyOnly.check(tcpAddr("198.51.100.1", 1)); err != nil {
+		t.Error(err)
+	}
+	if err := denyOnly.check(tcpAddr("192.0.2.1", 1)); err == nil {
+		t.Error("192.0.2.1 was allowed")
+	}
+
+	var nilList *accessList
+	if err := nilList.check(tcpAddr("192.0.2.1", 1)); err != nil {
+		t.Errorf("nil list refused a client: %v", err)
+	}
+}
+
+func TestAccessListInvalid(t *testing.T) {
+	if _, err := newAccessList("test", &ACL{Allow: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("invalid CIDR was accepted")
+	}
+
+	path := filepath.Join(t.TempDir(), "deny")
+	os.WriteFile(path, []byte("192.0.2.1\nnot an address\n"), 0o644)
+	if _, err := newAccessList("test", &ACL{DenyFile: path}); err == nil {
+		t.Error("invalid list file was accepted")
+	}
+}
+
+func TestAccessListReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny")
+	if err := os.WriteFile(path, []byte("# bad actors\n192.0.2.1\n198.51.100.0/24 # scanners\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	acl, err := newAccessList("test", &ACL{Deny: []string{"203.0.113.1"}, DenyFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(acl.Rules()); n != 3 {
+		t.Fatalf("loaded %v rules, want 3", n)
+	}
+
+	acl.check(tcpAddr("203.0.113.1", 1))
+	acl.check(tcpAddr("192.0.2.1", 1))
+	acl.check(tcpAddr("192.0.2.1", 1))
+	acl.check(tcpAddr("198.51.100.7", 1))
+	if acl.changed() {
+		t.Error("list changed without its file changing")
+	}
+
+	// 198.51.100.0/24 keeps its line, 192.0.2.1 moves and 192.0.2.2 is new
+	if err := os.WriteFile(path, []byte("192.0.2.1\n192.0.2.2\n198.51.100.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+	if !acl.changed() {
+		t.Fatal("list did not notice its file changing")
+	}
+	if err := acl.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	hits := make(map[string]uint64)
+	for _, rule := range acl.Rules() {
+		hits[rule.String()] = rule.Hits()
+	}
+	for rule, want := range map[string]uint64{
+		"deny 203.0.113.1/32 (config)":          1,
+		"deny 192.0.2.1/32 (" + path + ":1)":    0, // a different line is a different rule
+		"deny 192.0.2.2/32 (" + path + ":2)":    0,
+		"deny 198.51.100.0/24 (" + path + ":3)": 1,
+	} {
+		got, ok := hits[rule]
+		if !ok {
+			t.Errorf("rule %v missing after reload, have %v", rule, hits)
+		} else if got != want {
+			t.Errorf("rule %v has %v hits, want %v", rule, got, want)
+		}
+	}
+	if err := acl.check(tcpAddr("192.0.2.2", 1)); err == nil {
+		t.Error("rule added to the file was not applied")
+	}
+
+	// a broken file keeps the previous rules
+	os.WriteFile(path, []byte("garbage\n"), 0o644)
+	if err := acl.reload(); err == nil {
+		t.Error("broken file was loaded")
+	}
+	if err := acl.check(tcpAddr("192.0.2.2", 1)); err == nil {
+		t.Error("previous rules were dropped by a failed reload")
+	}
+}
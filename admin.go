@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Admin configures the admin API. It is only served when Address is set.
+type Admin struct {
+	Address string `yaml:"addr"`
+}
+
+type backendStatus struct {
+	Frontend string `json:"frontend"`
+	Backend  string `json:"backend"`
+	Draining bool   `json:"draining"`
+	Sessions int    `json:"sessions"`
+}
+
+func (s *Server) serveAdmin(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backends", s.handleBackends)
+	mux.HandleFunc("/backends/drain", s.handleDrain(true))
+	mux.HandleFunc("/backends/undrain", s.handleDrain(false))
+	mux.HandleFunc("/rules/explain", s.handleExplain)
+
+	s.Info("serving admin API", "addr", l.Addr())
+	if err := http.Serve(l, mux); err != nil {
+		s.Error("failed to serve admin API", "err", err)
+	}
+}
+
+func (s *Server) handleBackends(w http.ResponseWriter, req *http.Request) {
+	var status []backendStatus
+	for name, front := range s.Frontends {
+		for _, backend := range front.Backends {
+			state := backend.state
+			status = append(status, backendStatus{
+				Frontend: name,
+				Backend:  backend.Address,
+				Draining: state.isDraining(),
+				Sessions: s.sessions.count(func(sess *session) bool { return sess.backend.state == state }),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleDrain serves POST /backends/drain?frontend=<name>&backend=<addr> and
+// its undrain counterpart.
+func (s *Server) handleDrain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		front, ok := s.Frontends[req.FormValue("frontend")]
+		if !ok {
+			http.Error(w, "unknown frontend", http.StatusNotFound)
+			return
+		}
+
+		addr := req.FormValue("backend")
+		for _, backend := range front.Backends {
+			if backend.Address != addr {
+				continue
+			}
+			if draining {
+				go s.drainBackend(front, backend)
+			} else {
+				backend.state.setDraining(false)
+				s.Info("undrained backend", "frontend", front.name, "backend", backend.Address)
+			}
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		http.Error(w, "unknown backend", http.StatusNotFound)
+	}
+}
+
+type ruleExplanation struct {
+	Name     string      `json:"name"`
+	Frontend string      `json:"frontend"`
+	Checks   []ruleCheck `json:"checks"`
+	Matched  bool        `json:"matched"`
+	Hits     uint64      `json:"hits"`
+}
+
+type explanation struct {
+	Rules    []ruleExplanation `json:"rules"`
+	Rule     string            `json:"rule,omitempty"`
+	Frontend string            `json:"frontend,omitempty"`
+	Via      string            `json:"via"`
+}
+
+// handleExplain serves GET /rules/explain?sni=&source=&alpn=&version=&ja3=,
+// reporting how a connection with those attributes would be routed without
+// counting it as a rule hit. alpn takes a comma separated list and version
+// one of 1.0 to 1.3. listener picks the TCP listener, the first by default.
+func (s *Server) handleExplain(w http.ResponseWriter, req *http.Request) {
+	if len(s.muxes) == 0 {
+		http.Error(w, "no TCP listener", http.StatusNotFound)
+		return
+	}
+	ml := s.muxes[0]
+	if name := req.FormValue("listener"); name != "" {
+		ml = nil
+		for _, candidate := range s.muxes {
+			if candidate.name == name {
+				ml = candidate
+			}
+		}
+		if ml == nil {
+			http.Error(w, "unknown listener", http.StatusNotFound)
+			return
+		}
+	}
+
+	in := ruleInput{
+		Host:     normalize(req.FormValue("sni")),
+		Source:   net.ParseIP(req.FormValue("source")),
+		JA3:      strings.ToLower(req.FormValue("ja3")),
+		protocol: protoTLS,
+		tls:      true,
+	}
+	if alpn := req.FormValue("alpn"); alpn != "" {
+		in.ALPN = strings.Split(alpn, ",")
+	}
+	if version := req.FormValue("version"); version != "" {
+		v, ok := tlsVersions[version]
+		if !ok {
+			http.Error(w, "unknown TLS version", http.StatusBadRequest)
+			return
+		}
+		in.Version = v
+	}
+
+	var e explanation
+	for _, r := range s.rules.rules {
+		if r.protocol != in.protocol || !ml.frontends[r.frontend] {
+			continue
+		}
+		checks, matched := r.check(in)
+		e.Rules = append(e.Rules, ruleExplanation{
+			Name:     r.name,
+			Frontend: r.frontend,
+			Checks:   checks,
+			Matched:  matched,
+			Hits:     atomic.LoadUint64(&r.hits),
+		})
+		if matched && e.Rule == "" {
+			e.Rule, e.Frontend, e.Via = r.name, r.frontend, "rule"
+		}
+	}
+
+	if e.Via == "" {
+		if l, _, ok := ml.mux.get(protoTLS, in.Host); ok {
+			e.Frontend, e.Via = l.name, "route"
+		} else if front := s.fallbacks.frontend(in.Host); front != nil && ml.serves(front) {
+			e.Frontend, e.Via = front.name, "fallback"
+		} else {
+			e.Via = "none"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Alerts names the TLS alert sent for each class of routing failure, or none
+// to close the connection without one. Alerts are only sent once the client
+// has started a TLS handshake.
+type Alerts struct {
+	NotFound   string `yaml:"not_found"`   // no frontend or fallback for the server name
+	BadRequest string `yaml:"bad_request"` // the ClientHello could not be parsed
+	BadVersion string `yaml:"bad_version"` // the client speaks an unsupported version
+	Forbidden  string `yaml:"forbidden"`   // a frontend ACL refused the client
+	Overloaded string `yaml:"overloaded"`  // a frontend or backend limit was hit
+}
+
+const alertNone = "none"
+
+var (
+	defaultAlerts = Alerts{
+		NotFound:   "unrecognized_name",
+		BadRequest: "handshake_failure",
+		BadVersion: "protocol_version",
+		Forbidden:  "access_denied",
+		Overloaded: "internal_error",
+	}
+
+	alertNames = map[string]alert{
+		"unexpected_message": alertUnexpectedMessage,
+		"handshake_failure":  alertHandshakeFailure,
+		"access_denied":      alertAccessDenied,
+		"decode_error":       alertDecodeError,
+		"protocol_version":   alertProtocolVersion,
+		"internal_error":     alertInternalError,
+		"unrecognized_name":  alertUnrecognizedName,
+	}
+)
+
+// alertPolicy is the resolved form of Alerts. A zero alert means none.
+type alertPolicy struct {
+	notFound   alert
+	badRequest alert
+	badVersion alert
+	forbidden  alert
+	overloaded alert
+}
+
+func newAlertPolicy(conf Alerts) (*alertPolicy, error) {
+	p := new(alertPolicy)
+	for _, a := range []struct {
+		class string
+		name  string
+		def   string
+		dst   *alert
+	}{
+		{"not_found", conf.NotFound, defaultAlerts.NotFound, &p.notFound},
+		{"bad_request", conf.BadRequest, defaultAlerts.BadRequest, &p.badRequest},
+		{"bad_version", conf.BadVersion, defaultAlerts.BadVersion, &p.badVersion},
+		{"forbidden", conf.Forbidden, defaultAlerts.Forbidden, &p.forbidden},
+		{"overloaded", conf.Overloaded, defaultAlerts.Overloaded, &p.overloaded},
+	} {
+		name := strings.ToLower(a.name)
+		if name == "" {
+			name = a.def
+		}
+		if name == alertNone {
+			continue
+		}
+		v, ok := alertNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS alert '%v' for %v", a.name, a.class)
+		}
+		*a.dst = v
+	}
+	return p, nil
+}
+
+// forError picks the alert for a connection the muxer failed to route. It
+// returns false when the client should not get one: it never sent a
+// ClientHello, speaks another protocol, hung up, or ran out of time.
+func (p *alertPolicy) forError(conn net.Conn, err error) (*ClientHelloMessage, alert, bool) {
+	var hello *ClientHelloMessage
+	if tlsConn, ok := conn.(*TLSConn); ok {
+		hello = tlsConn.ClientHelloMessage
+	}
+
+	var a alert
+	switch e := err.(type) {
+	case NotFound:
+		if hello == nil {
+			return nil, 0, false
+		}
+		a = p.notFound
+	case Forbidden:
+		if hello == nil {
+			return nil, 0, false
+		}
+		a = p.forbidden
+	case BadRequest:
+		cause := e.error
+		var notTLS sniffError
+		if errors.As(cause, &notTLS) {
+			return nil, 0, false
+		}
+		if errors.Is(cause, io.EOF) || errors.Is(cause, io.ErrUnexpectedEOF) || errors.Is(cause, net.ErrClosed) {
+			return nil, 0, false
+		}
+		var netErr net.Error
+		if errors.As(cause, &netErr) && netErr.Timeout() {
+			return nil, 0, false
+		}
+		a = p.badRequest
+		if errors.Is(cause, alertProtocolVersion) {
+			a = p.badVersion
+		}
+	default:
+		return nil, 0, false
+	}
+	return hello, a, a != 0
+}
+
+// sendAlert tells the client why conn is about to be closed, if the policy
+// has an alert for err.
+func (s *Server) sendAlert(conn net.Conn, err error) {
+	hello, a, ok := s.alerts.forError(conn, err)
+	if !ok {
+		return
+	}
+	if err := writeAlert(conn, hello, a); err != nil {
+		s.Debug("failed to send TLS alert", "conn", connID(conn), "alert", a, "err", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBadVersionAlert(t *testing.T) {
+	policy, err := newAlertPolicy(Alerts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		record []byte
+		want   alert
+	}{
+		{"SSL 2.0", []byte{0x80, 0x2e, 0x01, 0x00, 0x02}, alertProtocolVersion},
+		{"SSL 3.0", clientHelloRecord(0x0300, "unknown.example.com"), alertUnrecognizedName}, // routed on the name
+		{"TLS 1.0", clientHelloRecord(0x0301, "unknown.example.com"), alertUnrecognizedName},
+	} {
+		mux := newTestMuxer(t)
+		c, err := net.Dial("tcp", mux.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write(tt.record)
+
+		conn, err := nextError(t, mux)
+		_, a, ok := policy.forError(conn, err)
+		if !ok || a != tt.want {
+			t.Errorf("%v: got alert %v (%v) for %v, want %v", tt.name, a, ok, err, tt.want)
+		}
+	}
+}
+
+func TestFrontendMinVersion(t *testing.T) {
+	backend := tlsEchoServer(t, "example.com")
+	s := startServer(t, `
+port: 127.0.0.1:0
+frontends:
+  example.com:
+    min_version: "1.2"
+    backends:
+      - addr: %v
+`, nil, backend)
+
+	old := &tls.Config{ServerName: "example.com", InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}
+	if c, err := tls.Dial("tcp", s.addr(), old); err == nil {
+		c.Close()
+		t.Error("TLS 1.1 client was proxied")
+	} else if !strings.Contains(err.Error(), "protocol version") {
+		t.Errorf("TLS 1.1 client failed with %v, want the protocol_version alert", err)
+	}
+
+	c, err := tls.Dial("tcp", s.addr(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if _, err := parseConfiguration([]byte(`
+frontends:
+  example.com:
+    min_version: "3.0"
+    backends:
+      - addr: 127.0.0.1:1
+`), loadTLSConfig); err == nil {
+		t.Error("unknown min_version was accepted")
+	}
+}
+
+func TestFallbackRejectCompat(t *testing.T) {
+	for _, tt := range []struct {
+		configuration string
+		want          alert
+	}{
+		{"fallback: {reject: true}", alertUnrecognizedName},
+		{"fallback: {reject: false}", 0},
+		{"fallback: {reject: false}\nalerts: {not_found: access_denied}", alertAccessDenied},
+	} {
+		config, err := parseConfiguration([]byte(tt.configuration+`
+frontends:
+  example.com:
+    backends:
+      - addr: 127.0.0.1:1
+`), loadTLSConfig)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.configuration, err)
+		}
+		if config.alerts.notFound != tt.want {
+			t.Errorf("%q: not_found alert is %v, want %v", tt.configuration, config.alerts.notFound, tt.want)
+		}
+	}
+}
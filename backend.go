@@ -5,7 +5,14 @@ const (
 )
 
 type Backend struct {
-	Protocol       string `yaml:"protocol"`
-	Address        string `yaml:"addr"`
-	ConnectTimeout int    `yaml:"timeout"`
+	Protocol       string     `yaml:"protocol"`
+	Address        string     `yaml:"addr"`
+	ConnectTimeout int        `yaml:"timeout"`
+	SendProxy      string     `yaml:"send_proxy"`
+	MaxConnections int        `yaml:"max_connections"`
+	Bandwidth      *Bandwidth `yaml:"bandwidth"`
+	conns          *connLimiter
+	state          *backendState
+	upload         *tokenBucket
+	download       *tokenBucket
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Bandwidth limits throughput in bytes per second. Upload is client to
+// backend, download is backend to client; zero means unlimited.
+type Bandwidth struct {
+	Upload   int `yaml:"upload"`
+	Download int `yaml:"download"`
+}
+
+func (b *Bandwidth) validate() error {
+	if b.Upload < 0 || b.Download < 0 {
+		return fmt.Errorf("bandwidth must not be negative")
+	}
+	return nil
+}
+
+// byteRate turns a rate in bytes per second into a token bucket
+// configuration holding one second worth of traffic.
+func byteRate(rate int) *RateLimit {
+	return &RateLimit{Rate: float64(rate), Burst: rate}
+}
+
+// newBandwidthBuckets returns the upload and download buckets for b. Either
+// is nil when that direction is unlimited.
+func newBandwidthBuckets(b *Bandwidth) (upload, download *tokenBucket) {
+	if b == nil {
+		return
+	}
+	if b.Upload > 0 {
+		upload = newTokenBucket(byteRate(b.Upload))
+	}
+	if b.Download > 0 {
+		download = newTokenBucket(byteRate(b.Download))
+	}
+	return
+}
+
+// clientBandwidth keeps separate upload and download buckets per client IP.
+type clientBandwidth struct {
+	upload   *sourceRateLimiter
+	download *sourceRateLimiter
+}
+
+func newClientBandwidth(b *Bandwidth) *clientBandwidth {
+	c := new(clientBandwidth)
+	if b.Upload > 0 {
+		c.upload = newSourceRateLimiter(byteRate(b.Upload))
+	}
+	if b.Download > 0 {
+		c.download = newSourceRateLimiter(byteRate(b.Download))
+	}
+	return c
+}
+
+func (c *clientBandwidth) buckets(addr net.Addr) (upload, download *tokenBucket) {
+	ip := addrIP(addr)
+	if c == nil || ip == nil {
+		return
+	}
+	now := time.Now()
+	if c.upload != nil {
+		upload = c.upload.bucket(ip, now)
+	}
+	if c.download != nil {
+		download = c.download.bucket(ip, now)
+	}
+	return
+}
+
+// shapedConn delays reads so that they never outpace any of its buckets.
+// Writes go straight through.
+type shapedConn struct {
+	net.Conn
+	buckets []*tokenBucket
+	chunk   int
+}
+
+// shape wraps c to read no faster than every non-nil bucket allows, or
+// returns c unchanged if there are none.
+func shape(c net.Conn, buckets ...*tokenBucket) net.Conn {
+	s := &shapedConn{Conn: c, chunk: copyBufSize}
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		s.buckets = append(s.buckets, b)
+		if burst := int(b.burst); burst > 0 && burst < s.chunk {
+			s.chunk = burst
+		}
+	}
+
+	if len(s.buckets) == 0 {
+		return c
+	}
+	return s
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if len(p) > c.chunk {
+		p = p[:c.chunk]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		var wait time.Duration
+		now := time.Now()
+		for _, b := range c.buckets {
+			if d := b.reserve(now, float64(n)); d > wait {
+				wait = d
+			}
+		}
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+func (c *shapedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
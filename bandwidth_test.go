@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestShapeWithoutBuckets(t *testing.T) {
+	c, _ := tcpPair(t)
+	if shaped := shape(c, nil, nil); shaped != c {
+		t.Errorf("unlimited connection was wrapped in %T", shaped)
+	}
+}
+
+func TestShapedConnRate(t *testing.T) {
+	c, s := tcpPair(t)
+	const size = 5000
+	go func() {
+		c.Write(make([]byte, size))
+		c.CloseWrite()
+	}()
+
+	// 1000 bytes come out of the burst, the other 4000 take 400ms
+	slow := newTokenBucket(&RateLimit{Rate: 10000, Burst: 1000})
+	fast := newTokenBucket(&RateLimit{Rate: 1e9, Burst: 1e9})
+	shaped := shape(s, fast, slow)
+	if chunk := shaped.(*shapedConn).chunk; chunk != 1000 {
+		t.Errorf("reads are split in chunks of %v, want the smallest burst", chunk)
+	}
+
+	start := time.Now()
+	buf := make([]byte, copyBufSize)
+	total := 0
+	for {
+		n, err := shaped.Read(buf)
+		if n > 1000 {
+			t.Errorf("read %v bytes at once", n)
+		}
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if total != size {
+		t.Errorf("read %v bytes, want %v", total, size)
+	}
+	if elapsed < 350*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("reading %v bytes at 10000 per second took %v", size, elapsed)
+	}
+}
+
+func TestClientBandwidth(t *testing.T) {
+	c := newClientBandwidth(&Bandwidth{Download: 1000})
+	up, down := c.buckets(tcpAddr("192.0.2.1", 1))
+	if up != nil || down == nil {
+		t.Fatalf("got upload %v and download %v, want only download", up, down)
+	}
+	if _, again := c.buckets(tcpAddr("192.0.2.1", 2)); again != down {
+		t.Error("connections from one client do not share a bucket")
+	}
+	if _, other := c.buckets(tcpAddr("192.0.2.2", 1)); other == down {
+		t.Error("two clients share a bucket")
+	}
+
+	var unlimited *clientBandwidth
+	if up, down := unlimited.buckets(tcpAddr("192.0.2.1", 1)); up != nil || down != nil {
+		t.Error("nil client bandwidth returned buckets")
+	}
+}
+
+func TestBandwidthValidate(t *testing.T) {
+	if err := (&Bandwidth{Upload: -1}).validate(); err == nil {
+		t.Error("negative bandwidth was accepted")
+	}
+	if up, down := newBandwidthBuckets(&Bandwidth{Upload: 100}); up == nil || down != nil {
+		t.Errorf("got upload %v and download %v, want only upload", up, down)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	copyBufSize             = 64 * 1024
+	spliceChunkSize         = 1 << 20
+	defaultHalfCloseTimeout = 60000 // milliseconds
+)
+
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufSize)
+		return &buf
+	},
+}
+
+// unwrapper is implemented by the connection wrappers that can be bypassed
+// once the muxer is done with them. netConn returns nil while the wrapper
+// still has work to do.
+type unwrapper interface {
+	netConn() net.Conn
+}
+
+// rawConn strips every wrapper that can be bypassed from c.
+func rawConn(c net.Conn) net.Conn {
+	for {
+		u, ok := c.(unwrapper)
+		if !ok {
+			return c
+		}
+		next := u.netConn()
+		if next == nil {
+			return c
+		}
+		c = next
+	}
+}
+
+// flusher is implemented by connections holding bytes that were read ahead,
+// such as the ClientHello peeked by the muxer.
+type flusher interface {
+	flushTo(w io.Writer) (int64, error)
+}
+
+// closeWrite shuts down the writing side of c, sending a close_notify for
+// terminated TLS connections and a FIN for TCP ones.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	if cw, ok := rawConn(c).(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// proxyCopy copies from src to dst like io.Copy, reporting every chunk
+// written to progress as it goes. Bytes read ahead by the muxer are written
+// first; after that, two plain TCP connections are joined with ReadFrom so
+// Linux can splice, and anything else is copied through a pooled buffer.
+func proxyCopy(dst, src net.Conn, progress func(int64)) (written int64, err error) {
+	if f, ok := src.(flusher); ok {
+		if written, err = f.flushTo(dst); err != nil {
+			return
+		}
+		progress(written)
+	}
+
+	dst, src = rawConn(dst), rawConn(src)
+
+	var n int64
+	if tcpDst, ok := dst.(*net.TCPConn); ok {
+		if tcpSrc, ok := src.(*net.TCPConn); ok {
+			// splicing through a LimitedReader still splices, and returns
+			// often enough for the byte counters to stay current
+			for {
+				n, err = tcpDst.ReadFrom(&io.LimitedReader{R: tcpSrc, N: spliceChunkSize})
+				written += n
+				progress(n)
+				if err != nil || n == 0 {
+					return
+				}
+			}
+		}
+	}
+
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+
+	for {
+		nr, rerr := src.Read(*buf)
+		if nr > 0 {
+			nw, werr := dst.Write((*buf)[:nr])
+			written += int64(nw)
+			progress(int64(nw))
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testProxyCopyProgress(t *testing.T, wrap func(net.Conn) net.Conn) {
+	client, in := tcpPair(t)
+	out, backend := tcpPair(t)
+
+	const size = 3*spliceChunkSize + 1234
+	payload := bytes.Repeat([]byte("tlsmux"), size/6+1)[:size]
+	go func() {
+		client.Write(payload)
+		client.CloseWrite()
+	}()
+
+	received := make(chan []byte)
+	go func() {
+		buf, _ := io.ReadAll(backend)
+		received <- buf
+	}()
+
+	var reports, total int64
+	n, err := proxyCopy(wrap(out), wrap(in), func(n int64) {
+		reports++
+		total += n
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.CloseWrite()
+
+	if n != size || total != size {
+		t.Errorf("copied %v bytes, reported %v, want %v", n, total, size)
+	}
+	if reports < 3 {
+		t.Errorf("progress reported %v times, want one per chunk", reports)
+	}
+	if got := <-received; !bytes.Equal(got, payload) {
+		t.Errorf("backend received %v bytes, not the payload", len(got))
+	}
+}
+
+func TestProxyCopyProgressSplice(t *testing.T) {
+	testProxyCopyProgress(t, func(c net.Conn) net.Conn { return c })
+}
+
+func TestProxyCopyProgressBuffered(t *testing.T) {
+	testProxyCopyProgress(t, func(c net.Conn) net.Conn { return struct{ net.Conn }{c} })
+}
+
+func benchmarkProxyCopy(b *testing.B, wrap func(net.Conn) net.Conn) {
+	client, in := tcpPair(b)
+	out, backend := tcpPair(b)
+
+	const size = 64 << 20
+	chunk := make([]byte, 32<<10)
+	go func() {
+		for written := 0; written < size*b.N; written += len(chunk) {
+			if _, err := client.Write(chunk); err != nil {
+				break
+			}
+		}
+		client.CloseWrite()
+	}()
+	go io.Copy(io.Discard, backend)
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	if _, err := proxyCopy(wrap(out), wrap(in), func(int64) {}); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkProxyCopySplice(b *testing.B) {
+	benchmarkProxyCopy(b, func(c net.Conn) net.Conn { return c })
+}
+
+func BenchmarkProxyCopyBuffered(b *testing.B) {
+	benchmarkProxyCopy(b, func(c net.Conn) net.Conn { return struct{ net.Conn }{c} })
+}
+
+// benchmarkJoinConnections proxies one short request and response per
+// iteration, opening a new client and backend connection each time, so that
+// the per-connection setup of joinConnections is measured along with the copy.
+func benchmarkJoinConnections(b *testing.B, front *Frontend) {
+	s := &Server{
+		Logger:        newLogger(io.Discard, logFormatLogfmt, slog.LevelError),
+		Configuration: &Configuration{},
+		metrics:       newMetrics(),
+	}
+	backend := Backend{Address: "backend"}
+	logger := s.Logger
+
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { l.Close() })
+		return l
+	}
+	clients, backends := listen(), listen()
+	dial := func(l net.Listener) (net.Conn, net.Conn) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		a, err := l.Accept()
+		if err != nil {
+			b.Fatal(err)
+		}
+		return c, a
+	}
+
+	request := make([]byte, 4<<10)
+	response := make([]byte, 16<<10)
+	b.SetBytes(int64(len(request) + len(response)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, in := dial(clients)
+		out, server := dial(backends)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			client.Write(request)
+			client.(*net.TCPConn).CloseWrite()
+			io.Copy(io.Discard, client)
+		}()
+		go func() {
+			defer wg.Done()
+			defer server.Close()
+			io.Copy(io.Discard, server)
+			server.Write(response)
+		}()
+
+		s.joinConnections(logger, in, out, front, backend, &accessLogEntry{Time: time.Now()})
+		wg.Wait()
+	}
+}
+
+func BenchmarkJoinConnectionsSplice(b *testing.B) {
+	benchmarkJoinConnections(b, &Frontend{name: "example.com", HalfCloseTimeout: 5000})
+}
+
+func BenchmarkJoinConnectionsBuffered(b *testing.B) {
+	benchmarkJoinConnections(b, &Frontend{name: "example.com", HalfCloseTimeout: 5000, IdleTimeout: 5000})
+}
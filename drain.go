@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 30000 // milliseconds
+)
+
+// backendState is shared by every copy of a Backend.
+type backendState struct {
+	draining int32
+}
+
+func (b *backendState) setDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&b.draining, v)
+}
+
+func (b *backendState) isDraining() bool {
+	return atomic.LoadInt32(&b.draining) == 1
+}
+
+// session is a client connection and, once it has been dialed, the backend
+// connection it is joined to. upstream, backend and closed are guarded by the
+// sessionSet's lock.
+type session struct {
+	client   io.Closer
+	upstream io.Closer
+	front    *Frontend
+	backend  Backend
+	closed   bool
+}
+
+func (s *session) close() {
+	s.closed = true
+	s.client.Close()
+	if s.upstream != nil {
+		s.upstream.Close()
+	}
+}
+
+// sessionSet tracks live sessions so they can be waited for or force-closed.
+type sessionSet struct {
+	sync.Mutex
+	sessions map[*session]struct{}
+	drained  chan struct{} // closed whenever no session is left
+}
+
+func newSessionSet() *sessionSet {
+	drained := make(chan struct{})
+	close(drained)
+	return &sessionSet{sessions: make(map[*session]struct{}), drained: drained}
+}
+
+func (s *sessionSet) add(sess *session) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.sessions) == 0 {
+		s.drained = make(chan struct{})
+	}
+	s.sessions[sess] = struct{}{}
+}
+
+func (s *sessionSet) remove(sess *session) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.sessions[sess]; ok {
+		delete(s.sessions, sess)
+		if len(s.sessions) == 0 {
+			close(s.drained)
+		}
+	}
+}
+
+// attach records the backend connection of a session. It returns false if
+// the session was force-closed while the backend was being dialed.
+func (s *sessionSet) attach(sess *session, upstream io.Closer, backend Backend) bool {
+	s.Lock()
+	defer s.Unlock()
+	if sess.closed {
+		return false
+	}
+	sess.upstream, sess.backend = upstream, backend
+	return true
+}
+
+// count returns the number of live sessions matching match.
+func (s *sessionSet) count(match func(*session) bool) (n int) {
+	s.Lock()
+	defer s.Unlock()
+	for sess := range s.sessions {
+		if match(sess) {
+			n++
+		}
+	}
+	return
+}
+
+// closeMatching force-closes the live sessions matching match and returns how
+// many there were.
+func (s *sessionSet) closeMatching(match func(*session) bool) (n int) {
+	s.Lock()
+	defer s.Unlock()
+	for sess := range s.sessions {
+		if match(sess) {
+			sess.close()
+			n++
+		}
+	}
+	return
+}
+
+// wait blocks until every session has finished or timeout expires, and
+// reports whether they all finished.
+func (s *sessionSet) wait(timeout time.Duration) bool {
+	s.Lock()
+	drained := s.drained
+	s.Unlock()
+
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func all(*session) bool { return true }
+
+// Shutdown stops accepting connections. Run then drains the live sessions and
+// returns.
+func (s *Server) Shutdown() {
+	s.shutdown.Do(func() {
+		s.Info("shutting down, draining connections", "timeout", time.Duration(s.DrainTimeout)*time.Millisecond)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.closing = true
+		for _, l := range s.listeners {
+			l.Close()
+		}
+	})
+}
+
+// track registers a listener or packet socket to be closed by Shutdown,
+// closing it right away if Shutdown has already been called.
+func (s *Server) track(l io.Closer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.listeners = append(s.listeners, l)
+	if s.closing {
+		l.Close()
+	}
+}
+
+// drain waits for live sessions up to the drain timeout, then force-closes the
+// rest.
+func (s *Server) drain() {
+	if s.sessions.wait(time.Duration(s.DrainTimeout) * time.Millisecond) {
+		s.Info("all connections drained")
+		return
+	}
+
+	n := s.sessions.closeMatching(all)
+	s.Warn("drain timeout expired, closed remaining connections", "count", n)
+	s.sessions.wait(time.Duration(s.DrainTimeout) * time.Millisecond)
+}
+
+// drainBackend stops sending new connections to a backend and force-closes
+// whatever is still connected to it once the drain timeout expires.
+func (s *Server) drainBackend(front *Frontend, backend Backend) {
+	backend.state.setDraining(true)
+	s.Info("draining backend", "frontend", front.name, "backend", backend.Address)
+
+	match := func(sess *session) bool {
+		return sess.front == front && sess.backend.state == backend.state
+	}
+
+	deadline := time.Now().Add(time.Duration(s.DrainTimeout) * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if !backend.state.isDraining() || s.sessions.count(match) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if backend.state.isDraining() {
+		n := s.sessions.closeMatching(match)
+		s.Warn("backend drain timeout expired, closed remaining connections", "frontend", front.name, "backend", backend.Address, "count", n)
+	}
+}
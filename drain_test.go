@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	backend := tlsEchoServer(t, "example.com")
+	s := startServer(t, `
+port: 127.0.0.1:0
+drain_timeout: 5000
+frontends:
+  example.com:
+    backends:
+      - addr: %v
+`, nil, backend)
+
+	c, err := tls.Dial("tcp", s.addr(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.stop() }()
+
+	// the session keeps working while the server drains
+	buf := make([]byte, 5)
+	for i := 0; i < 3; i++ {
+		c.Write([]byte("hello"))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			t.Fatalf("session broke during drain: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("server stopped with a live session: %v", err)
+	default:
+	}
+
+	c.Close()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not stop once the session closed")
+	}
+}
+
+func TestShutdownWithConnectionsInFlight(t *testing.T) {
+	backend := tlsEchoServer(t, "example.com")
+	s := startServer(t, `
+port: 127.0.0.1:0
+drain_timeout: 200
+frontends:
+  example.com:
+    backends:
+      - addr: %v
+`, nil, backend)
+	addr := s.addr()
+
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				c, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+				if err != nil {
+					continue
+				}
+				c.Write([]byte("hello"))
+				c.SetDeadline(time.Now().Add(time.Second))
+				io.ReadFull(c, make([]byte, 5))
+				c.Close()
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop with connections in flight")
+	}
+	close(quit)
+	wg.Wait()
+}
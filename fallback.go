@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Fallback decides where connections go when their server name matches no
+// frontend. Domains maps wildcard patterns such as *.example.com to the
+// frontend handling unknown names below them, NoSNI names the frontend for
+// ClientHellos without a server name. The frontend marked as default is tried
+// after the domains; anything left is answered with the not_found alert.
+// Reject is deprecated: it picks between unrecognized_name and no alert when
+// alerts.not_found is not set.
+type Fallback struct {
+	Domains map[string]string `yaml:"domains"`
+	NoSNI   string            `yaml:"no_sni"`
+	Reject  *bool             `yaml:"reject"`
+}
+
+// fallbackChain is the resolved form of Fallback.
+type fallbackChain struct {
+	domains map[string]*Frontend
+	noSNI   *Frontend
+	def     *Frontend
+}
+
+func newFallbackChain(conf Fallback, frontends map[string]*Frontend, def *Frontend) (*fallbackChain, error) {
+	c := &fallbackChain{
+		domains: make(map[string]*Frontend),
+		def:     def,
+	}
+
+	for pattern, name := range conf.Domains {
+		if !strings.HasPrefix(pattern, "*.") {
+			return nil, fmt.Errorf("fallback domain '%v' must start with '*.'", pattern)
+		}
+		front, ok := frontends[name]
+		if !ok {
+			return nil, fmt.Errorf("fallback domain '%v' names unknown frontend '%v'", pattern, name)
+		}
+		c.domains[normalize(pattern)] = front
+	}
+
+	if conf.NoSNI != "" {
+		front, ok := frontends[conf.NoSNI]
+		if !ok {
+			return nil, fmt.Errorf("no_sni fallback names unknown frontend '%v'", conf.NoSNI)
+		}
+		c.noSNI = front
+	}
+
+	return c, nil
+}
+
+// frontend returns the frontend for a connection to host that no frontend
+// claimed, or nil when there is none.
+func (c *fallbackChain) frontend(host string) *Frontend {
+	host = normalize(host)
+	if host == "" && c.noSNI != nil {
+		return c.noSNI
+	}
+
+	if host != "" {
+		parts := strings.Split(host, ".")
+		for i := 0; i < len(parts)-1; i++ {
+			parts[i] = "*"
+			if front, ok := c.domains[strings.Join(parts[i:], ".")]; ok {
+				return front
+			}
+		}
+	}
+
+	return c.def
+}
+
+// fallback hands conn, for which the muxer found no frontend, down the
+// fallback chain. It returns false when no frontend took the connection.
+// Only TLS connections fall back, and only to frontends the listener serves.
+func (s *Server) fallback(conn net.Conn, ml *muxListener) bool {
+	tlsConn, ok := conn.(*TLSConn)
+	if !ok {
+		return false
+	}
+	host := tlsConn.Host()
+
+	if front := s.fallbacks.frontend(host); front != nil && ml.serves(front) {
+		if err := front.acl.check(conn.RemoteAddr()); err != nil {
+			s.Warn("fallback frontend refused connection", "conn", connID(conn), "remote", conn.RemoteAddr(), "frontend", front.name, "err", err)
+			return false
+		}
+		front.logger.Debug("falling back", "conn", connID(conn), "host", host)
+		s.handOff(conn, front)
+		return true
+	}
+	return false
+}
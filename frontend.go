@@ -2,15 +2,36 @@ package main
 
 import (
 	"crypto/tls"
+	"log/slog"
 )
 
 type Frontend struct {
-	Backends  []Backend
-	Strategy  string
-	TLSCert   string
-	TLSKey    string
-	Default   bool
-	strategy  BackendStrategy
-	tlsConfig *tls.Config
-	mux       *Muxer
-}
\ No newline at end of file
+	Backends         []Backend
+	Strategy         string
+	TLSCert          string
+	TLSKey           string
+	Default          bool
+	ACL              *ACL       `yaml:"acl"`
+	RateLimit        *RateLimit `yaml:"rate_limit"`
+	MaxConnections   int        `yaml:"max_connections"`
+	LogLevel         string     `yaml:"log_level"`
+	HalfCloseTimeout int        `yaml:"half_close_timeout"`
+	IdleTimeout      int        `yaml:"idle_timeout"`
+	SessionTimeout   int        `yaml:"session_timeout"`
+	HandshakeTimeout int        `yaml:"handshake_timeout"`
+	KeepAlive        int        `yaml:"keep_alive"`
+	Bandwidth        *Bandwidth `yaml:"bandwidth"`
+	NoRedirect       bool       `yaml:"no_redirect"`
+	MinVersion       string     `yaml:"min_version"` // 1.0, 1.1, 1.2 or 1.3
+	name             string
+	logger           *slog.Logger
+	acl              *accessList
+	rate             *tokenBucket
+	conns            *connLimiter
+	upload           *tokenBucket
+	download         *tokenBucket
+	strategy         BackendStrategy
+	tlsConfig        *tls.Config
+	minVersion       uint16
+	mux              *Muxer
+}
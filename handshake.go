@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxInFlight    = 4096
+	defaultMinMuxTimeout  = 1000 // milliseconds
+	defaultHandshakeGrace = 1000 // milliseconds
+)
+
+var errHandshakeTooSlow = errors.New("client sent its handshake too slowly")
+
+// HandshakeLimits bounds the resources spent reading vhost names. At most
+// MaxInFlight connections are parsed at once, and the time each one gets
+// shrinks from Timeout towards MinTimeout as the pool fills up. Clients must
+// also keep sending at MinRate bytes per second once Grace has passed. Zero
+// values other than MinRate take the defaults; the pool is always bounded.
+type HandshakeLimits struct {
+	MaxInFlight int `yaml:"max_in_flight"`
+	Timeout     int `yaml:"timeout"`
+	MinTimeout  int `yaml:"min_timeout"`
+	MinRate     int `yaml:"min_rate"`
+	Grace       int `yaml:"grace"`
+}
+
+func (h *HandshakeLimits) setDefaults() error {
+	if h.MaxInFlight == 0 {
+		h.MaxInFlight = defaultMaxInFlight
+	}
+	if h.Timeout == 0 {
+		h.Timeout = int(muxTimeout / time.Millisecond)
+	}
+	if h.MinTimeout == 0 {
+		h.MinTimeout = defaultMinMuxTimeout
+	}
+	if h.Grace == 0 {
+		h.Grace = defaultHandshakeGrace
+	}
+
+	if h.MaxInFlight < 0 || h.Timeout < 0 || h.MinTimeout < 0 || h.MinRate < 0 || h.Grace < 0 {
+		return fmt.Errorf("handshake limits must not be negative")
+	}
+	if h.MinTimeout > h.Timeout {
+		return fmt.Errorf("handshake min_timeout must not exceed timeout")
+	}
+	return nil
+}
+
+// HandshakeStats counts connections dropped before their vhost name was read.
+type HandshakeStats struct {
+	PoolFull uint64
+	TimedOut uint64
+	TooSlow  uint64
+}
+
+type handshakeStats struct {
+	poolFull uint64
+	timedOut uint64
+	tooSlow  uint64
+}
+
+func (s *handshakeStats) snapshot() HandshakeStats {
+	return HandshakeStats{
+		PoolFull: atomic.LoadUint64(&s.poolFull),
+		TimedOut: atomic.LoadUint64(&s.timedOut),
+		TooSlow:  atomic.LoadUint64(&s.tooSlow),
+	}
+}
+
+// connMeta follows a connection from the moment Muxer.handle picks it up
+// through every wrapper put around it, see metaOf.
+type connMeta struct {
+	id       uint64
+	accepted time.Time
+	sniffed  time.Time
+	routed   time.Time
+	captures []string // parts of the server name captured by the route
+}
+
+// metaOf returns the metadata of a connection that passed through the muxer,
+// or nil.
+func metaOf(conn net.Conn) *connMeta {
+	if c, ok := conn.(interface{ meta() *connMeta }); ok {
+		return c.meta()
+	}
+	return nil
+}
+
+// handshakeConn enforces a minimum byte rate while the vhost name is read by
+// moving the read deadline forward only as fast as the client sends data.
+// Once done is called it is a plain passthrough.
+type handshakeConn struct {
+	net.Conn
+	m        *connMeta
+	deadline time.Time
+	grace    time.Duration
+	minRate  int
+	n        int
+	slow     bool
+	expired  bool
+	done     int32
+}
+
+func (c *handshakeConn) Read(p []byte) (n int, err error) {
+	if atomic.LoadInt32(&c.done) == 1 {
+		return c.Conn.Read(p)
+	}
+
+	deadline := c.deadline
+	c.slow = false
+	if c.minRate > 0 {
+		next := c.m.accepted.Add(c.grace + time.Duration(c.n+1)*time.Second/time.Duration(c.minRate))
+		if next.Before(deadline) {
+			deadline, c.slow = next, true
+		}
+	}
+	if err = c.Conn.SetReadDeadline(deadline); err != nil {
+		return
+	}
+
+	n, err = c.Conn.Read(p)
+	c.n += n
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		c.expired = true
+		if c.slow {
+			err = errHandshakeTooSlow
+		}
+	}
+	return
+}
+
+func (c *handshakeConn) meta() *connMeta {
+	return c.m
+}
+
+func (c *handshakeConn) netConn() net.Conn {
+	if atomic.LoadInt32(&c.done) == 0 {
+		return nil
+	}
+	return c.Conn
+}
+
+func (c *handshakeConn) finish() {
+	atomic.StoreInt32(&c.done, 1)
+}
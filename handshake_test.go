@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHandshakeTestMuxer starts a TLS muxer on a loopback port with limits.
+func newHandshakeTestMuxer(t *testing.T, limits HandshakeLimits) *TLSMuxer {
+	t.Helper()
+	if err := limits.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := NewTLSMuxer(l, limits, new(uint64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return mux
+}
+
+func TestHandshakeLimitsDefaults(t *testing.T) {
+	var h HandshakeLimits
+	if err := h.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if h.MaxInFlight != defaultMaxInFlight || h.MinTimeout != defaultMinMuxTimeout || h.Grace != defaultHandshakeGrace || h.MinRate != 0 {
+		t.Errorf("defaults are %+v", h)
+	}
+
+	for _, invalid := range []HandshakeLimits{
+		{MaxInFlight: -1},
+		{MinRate: -1},
+		{Timeout: 500, MinTimeout: 1000},
+	} {
+		if err := invalid.setDefaults(); err == nil {
+			t.Errorf("%+v was accepted", invalid)
+		}
+	}
+}
+
+func TestHandshakeTimeoutShrinks(t *testing.T) {
+	m := &Muxer{
+		muxTimeout:    10 * time.Second,
+		minMuxTimeout: 2 * time.Second,
+		slots:         make(chan struct{}, 4),
+	}
+	for _, want := range []time.Duration{10 * time.Second, 8 * time.Second, 6 * time.Second, 4 * time.Second, 2 * time.Second} {
+		if got := m.handshakeTimeout(); got != want {
+			t.Errorf("with %v of %v slots taken, timeout is %v, want %v", len(m.slots), cap(m.slots), got, want)
+		}
+		select {
+		case m.slots <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func TestHandshakePoolFull(t *testing.T) {
+	mux := newHandshakeTestMuxer(t, HandshakeLimits{MaxInFlight: 1})
+
+	// the first client takes the only slot and sends nothing
+	idle, err := net.Dial("tcp", mux.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	c, err := net.Dial("tcp", mux.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("client over the pool got %v, want the connection closed", err)
+	}
+	if n := mux.HandshakeStats().PoolFull; n != 1 {
+		t.Errorf("%v connections dropped for a full pool, want 1", n)
+	}
+}
+
+func TestHandshakeTimedOut(t *testing.T) {
+	mux := newHandshakeTestMuxer(t, HandshakeLimits{Timeout: 200, MinTimeout: 100})
+	c, err := net.Dial("tcp", mux.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(clientHelloRecord(0x0301, "example.com")[:10])
+
+	if _, err := nextError(t, mux); err == nil {
+		t.Fatal("no error for a stalled handshake")
+	}
+	stats := mux.HandshakeStats()
+	if stats.TimedOut != 1 || stats.TooSlow != 0 {
+		t.Errorf("stats are %+v, want one timeout", stats)
+	}
+}
+
+func TestHandshakeTooSlow(t *testing.T) {
+	mux := newHandshakeTestMuxer(t, HandshakeLimits{Timeout: 10000, MinRate: 100, Grace: 100})
+	c, err := net.Dial("tcp", mux.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// one byte every 50ms is well below 100 bytes per second
+	start := time.Now()
+	go func() {
+		for _, b := range clientHelloRecord(0x0301, "example.com") {
+			if _, err := c.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	_, err = nextError(t, mux)
+	if err == nil || !strings.Contains(err.Error(), errHandshakeTooSlow.Error()) {
+		t.Errorf("got %v, want %v", err, errHandshakeTooSlow)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("slow client lasted %v", elapsed)
+	}
+	stats := mux.HandshakeStats()
+	if stats.TooSlow != 1 || stats.TimedOut != 0 {
+		t.Errorf("stats are %+v, want one too slow", stats)
+	}
+}
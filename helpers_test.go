@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway certificate authority for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "tlsmux test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate for names signed by the CA, with the CA in its
+// chain.
+func (ca *testCA) issue(t *testing.T, ocspServer string, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ocspServer != "" {
+		tmpl.OCSPServer = []string{ocspServer}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+// clientHelloRecord builds a minimal ClientHello record offering vers, with a
+// server_name extension when sni is not empty.
+func clientHelloRecord(vers uint16, sni string) []byte {
+	body := []byte{byte(vers >> 8), byte(vers)}
+	body = append(body, make([]byte, 32)...) // random
+	body = append(body, 0)                   // session ID
+	body = append(body, 0, 2, 0x00, 0x2f)    // TLS_RSA_WITH_AES_128_CBC_SHA
+	body = append(body, 1, 0)                // null compression
+	if sni != "" {
+		n := len(sni)
+		ext := []byte{0, 0, byte((n + 5) >> 8), byte(n + 5), byte((n + 3) >> 8), byte(n + 3), 0, byte(n >> 8), byte(n)}
+		ext = append(ext, sni...)
+		body = append(body, byte(len(ext)>>8), byte(len(ext)))
+		body = append(body, ext...)
+	}
+
+	hs := []byte{typeClientHello, 0, byte(len(body) >> 8), byte(len(body))}
+	hs = append(hs, body...)
+	record := []byte{byte(recordTypeHandshake), 3, 1, byte(len(hs) >> 8), byte(len(hs))}
+	return append(record, hs...)
+}
+
+// testServer is a server running in the background of a test.
+type testServer struct {
+	*Server
+	done    chan error
+	stopped sync.Once
+	err     error
+}
+
+// startServer runs a server for configuration, which is formatted with args
+// first, until the test ends. It returns once the server is listening.
+func startServer(t *testing.T, configuration string, prepare func(*Server), args ...interface{}) *testServer {
+	t.Helper()
+	config, err := parseConfiguration([]byte(fmt.Sprintf(configuration, args...)), loadTLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testServer{
+		Server: &Server{
+			Configuration: config,
+			Logger:        newLogger(io.Discard, logFormatLogfmt, slog.LevelError),
+			logOutput:     io.Discard,
+			ready:         make(chan int),
+		},
+		done: make(chan error, 1),
+	}
+	if prepare != nil {
+		prepare(s.Server)
+	}
+
+	go func() { s.done <- s.Run() }()
+	select {
+	case <-s.ready:
+	case err := <-s.done:
+		t.Fatalf("server failed to start: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := s.stop(); err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+	})
+	return s
+}
+
+// stop shuts the server down and waits for it to drain.
+func (s *testServer) stop() error {
+	s.stopped.Do(func() {
+		s.Shutdown()
+		s.err = <-s.done
+	})
+	return s.err
+}
+
+// addr returns the address of the server's first TCP listener.
+func (s *testServer) addr() string {
+	return s.muxes[0].mux.listener.Addr().String()
+}
+
+// echoServer accepts connections on a loopback port, wrapped by wrap if it
+// is not nil, and echoes whatever they send until they half-close.
+func echoServer(t *testing.T, wrap func(net.Listener) net.Listener) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	if wrap != nil {
+		l = wrap(l)
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// tlsEchoServer is echoServer terminating TLS with a certificate for names.
+func tlsEchoServer(t *testing.T, names ...string) string {
+	cert := newTestCA(t).issue(t, "", names...)
+	return echoServer(t, func(l net.Listener) net.Listener {
+		return tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	})
+}
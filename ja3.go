@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// JA3 returns the JA3 fingerprint of the ClientHello, see
+// https://github.com/salesforce/ja3. GREASE values are ignored.
+func (m *ClientHelloMessage) JA3() string {
+	sum := md5.Sum([]byte(m.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA3String returns the string the JA3 fingerprint is a hash of.
+func (m *ClientHelloMessage) JA3String() string {
+	points := make([]uint16, len(m.SupportedPoints))
+	for i, p := range m.SupportedPoints {
+		points[i] = uint16(p)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(m.Vers)),
+		joinJA3(m.CipherSuites),
+		joinJA3(m.Extensions),
+		joinJA3(m.SupportedCurves),
+		joinJA3(points),
+	}, ",")
+}
+
+func joinJA3(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGREASE reports whether v is one of the reserved values from RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the example from https://github.com/salesforce/ja3
+func TestJA3KnownFingerprint(t *testing.T) {
+	hello := &ClientHelloMessage{
+		Vers:            0x0301,
+		CipherSuites:    []uint16{0x0a0a, 47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+		Extensions:      []uint16{0x2a2a, 0, 10, 11},
+		SupportedCurves: []uint16{0x3a3a, 23, 24, 25},
+		SupportedPoints: []uint8{0},
+	}
+
+	if s := hello.JA3String(); s != "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0" {
+		t.Errorf("JA3 string is %q", s)
+	}
+	if ja3 := hello.JA3(); ja3 != "ada70206e40642a3e4461f35503241d5" {
+		t.Errorf("JA3 is %v", ja3)
+	}
+}
+
+func TestJA3FromClientHello(t *testing.T) {
+	hello, err := readClientHello(bytes.NewReader(clientHelloRecord(0x0303, "example.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := hello.JA3String(); s != "771,47,0,," {
+		t.Errorf("JA3 string is %q", s)
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for v, want := range map[uint16]bool{
+		0x0a0a: true,
+		0xfafa: true,
+		0x1a2a: false,
+		0x0a1a: false,
+		0x002f: false,
+	} {
+		if isGREASE(v) != want {
+			t.Errorf("isGREASE(%#04x) is %v", v, !want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	bucketSweepInterval = time.Minute
+)
+
+// RateLimit is a token bucket refilling Rate tokens per second up to Burst.
+// Each new connection takes one token.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (r *RateLimit) validate() error {
+	if r.Rate <= 0 {
+		return fmt.Errorf("rate limit must be positive")
+	}
+	if r.Burst == 0 {
+		r.Burst = int(r.Rate)
+		if r.Burst < 1 {
+			r.Burst = 1
+		}
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("rate limit burst must not be negative")
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(conf *RateLimit) *tokenBucket {
+	return &tokenBucket{
+		rate:   conf.Rate,
+		burst:  float64(conf.Burst),
+		tokens: float64(conf.Burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the last call. A caller may have read
+// the clock before the bucket was made, so now can be slightly in the past.
+func (b *tokenBucket) refill(now time.Time) {
+	if now.Before(b.last) {
+		return
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes a token if one is available. A nil bucket allows everything.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes n tokens, going into debt if needed, and returns how long the
+// caller has to wait for the debt to be repaid.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely, so dropping it is
+// indistinguishable from keeping it.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// sourceRateLimiter keeps one token bucket per client IP.
+type sourceRateLimiter struct {
+	sync.Mutex
+	conf      *RateLimit
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newSourceRateLimiter(conf *RateLimit) *sourceRateLimiter {
+	return &sourceRateLimiter{
+		conf:      conf,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *sourceRateLimiter) check(addr net.Addr) error {
+	if l == nil {
+		return nil
+	}
+
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if !l.bucket(ip, now).allow(now) {
+		return Overloaded{fmt.Errorf("connection rate limit exceeded for %v", ip)}
+	}
+	return nil
+}
+
+// bucket returns the bucket for ip, creating it if needed. Buckets that have
+// refilled completely are dropped from time to time.
+func (l *sourceRateLimiter) bucket(ip net.IP, now time.Time) *tokenBucket {
+	key := ip.String()
+
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.lastSweep) > bucketSweepInterval {
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(l.conf)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// connLimiter caps the number of concurrent connections. A nil limiter, or one
+// with a max of zero, is unlimited.
+type connLimiter struct {
+	max    int64
+	active int64
+}
+
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{max: int64(max)}
+}
+
+func (l *connLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if atomic.AddInt64(&l.active, 1) > l.max {
+		atomic.AddInt64(&l.active, -1)
+		return false
+	}
+	return true
+}
+
+func (l *connLimiter) release() {
+	if l != nil {
+		atomic.AddInt64(&l.active, -1)
+	}
+}
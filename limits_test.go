@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(&RateLimit{Rate: 10, Burst: 3})
+	b.last = now
+
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("token %v of the burst refused", i)
+		}
+	}
+	if b.allow(now) {
+		t.Error("token allowed beyond the burst")
+	}
+	if !b.allow(now.Add(100 * time.Millisecond)) {
+		t.Error("no token after refilling for one")
+	}
+	if b.full(now.Add(100 * time.Millisecond)) {
+		t.Error("bucket full right after taking a token")
+	}
+	if !b.full(now.Add(time.Hour)) {
+		t.Error("bucket not full after an hour")
+	}
+
+	var nilBucket *tokenBucket
+	if !nilBucket.allow(now) {
+		t.Error("nil bucket refused a token")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(&RateLimit{Rate: 1000, Burst: 1000})
+	b.last = now
+
+	if wait := b.reserve(now, 1000); wait != 0 {
+		t.Errorf("waiting %v for the burst", wait)
+	}
+	if wait := b.reserve(now, 500); wait != 500*time.Millisecond {
+		t.Errorf("waiting %v for 500 tokens of debt, want 500ms", wait)
+	}
+	// the debt is repaid before new tokens count
+	if wait := b.reserve(now.Add(250*time.Millisecond), 250); wait != 500*time.Millisecond {
+		t.Errorf("waiting %v after repaying half the debt, want 500ms", wait)
+	}
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	for _, tt := range []struct {
+		conf  RateLimit
+		burst int
+		ok    bool
+	}{
+		{RateLimit{Rate: 50}, 50, true},
+		{RateLimit{Rate: 0.5}, 1, true},
+		{RateLimit{Rate: 5, Burst: 20}, 20, true},
+		{RateLimit{Rate: 0}, 0, false},
+		{RateLimit{Rate: 5, Burst: -1}, 0, false},
+	} {
+		conf := tt.conf
+		err := conf.validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: %v", tt.conf, err)
+		}
+		if tt.ok && conf.Burst != tt.burst {
+			t.Errorf("%+v: burst is %v, want %v", tt.conf, conf.Burst, tt.burst)
+		}
+	}
+}
+
+func TestSourceRateLimiter(t *testing.T) {
+	l := newSourceRateLimiter(&RateLimit{Rate: 0.001, Burst: 2})
+	for i := 0; i < 2; i++ {
+		if err := l.check(tcpAddr("192.0.2.1", 1000+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := l.check(tcpAddr("192.0.2.1", 2000)).(Overloaded); !ok {
+		t.Error("third connection from 192.0.2.1 was not refused")
+	}
+	if err := l.check(tcpAddr("192.0.2.2", 1000)); err != nil {
+		t.Errorf("another client shares the bucket: %v", err)
+	}
+
+	// a bucket made after the clock was read still starts full
+	single := newSourceRateLimiter(&RateLimit{Rate: 0.001, Burst: 1})
+	if err := single.check(tcpAddr("192.0.2.1", 1000)); err != nil {
+		t.Errorf("first connection refused with a burst of one: %v", err)
+	}
+
+	// full buckets are swept
+	l.lastSweep = time.Now().Add(-2 * bucketSweepInterval)
+	l.buckets["192.0.2.3"] = newTokenBucket(l.conf)
+	l.bucket(tcpAddr("192.0.2.4", 1).IP, time.Now())
+	if _, ok := l.buckets["192.0.2.3"]; ok {
+		t.Error("full bucket was not swept")
+	}
+	if _, ok := l.buckets["192.0.2.1"]; !ok {
+		t.Error("empty bucket was swept")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	if newConnLimiter(0) != nil {
+		t.Error("a max of zero is not unlimited")
+	}
+	var unlimited *connLimiter
+	if !unlimited.acquire() {
+		t.Error("nil limiter refused a connection")
+	}
+	unlimited.release()
+
+	l := newConnLimiter(2)
+	if !l.acquire() || !l.acquire() {
+		t.Fatal("connection under the cap refused")
+	}
+	if l.acquire() {
+		t.Error("connection over the cap allowed")
+	}
+	l.release()
+	if !l.acquire() {
+		t.Error("released slot not reused")
+	}
+}
+
+// testLimitAlert holds one session open through a server configured with
+// limits and checks that a second connection gets the overloaded alert.
+func testLimitAlert(t *testing.T, limits string) {
+	backend := tlsEchoServer(t, "example.com")
+	s := startServer(t, `
+port: 127.0.0.1:0
+frontends:
+  example.com:
+`+limits+`
+`, nil, backend)
+
+	config := &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}
+	first, err := tls.Dial("tcp", s.addr(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("hello"))
+	if _, err := io.ReadFull(first, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := tls.Dial("tcp", s.addr(), config)
+	if err == nil {
+		second.Close()
+		t.Fatal("second connection was proxied")
+	}
+	if !strings.Contains(err.Error(), "internal error") {
+		t.Errorf("second connection failed with %v, want the internal_error alert", err)
+	}
+}
+
+func TestFrontendConnectionCap(t *testing.T) {
+	testLimitAlert(t, `
+    max_connections: 1
+    backends:
+      - addr: %v`)
+}
+
+func TestBackendConnectionCap(t *testing.T) {
+	testLimitAlert(t, `
+    backends:
+      - addr: %v
+        max_connections: 1`)
+}
+
+func TestFrontendRateLimit(t *testing.T) {
+	testLimitAlert(t, `
+    rate_limit: {rate: 0.001, burst: 1}
+    backends:
+      - addr: %v`)
+}
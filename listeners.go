@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Listen configures one listening socket with its own muxer. Protocol is
+// tcp, tcp4, tcp6 or unix, or udp, udp4 or udp6 for QUIC. Frontends restricts
+// the socket to the named frontends; by default it serves all of them, or for
+// QUIC, all the TLS frontends that are not terminated.
+type Listen struct {
+	Name      string   `yaml:"name"`
+	Protocol  string   `yaml:"protocol"`
+	Address   string   `yaml:"addr"`
+	Frontends []string `yaml:"frontends"`
+}
+
+// reserved listener names, used for the other sockets handed over on upgrade
+var reservedListenerNames = map[string]bool{
+	"redirect": true,
+	"metrics":  true,
+	"admin":    true,
+}
+
+// setListenerDefaults fills in the listeners of config, falling back to the
+// single protocol and port settings, and checks that every frontend is served.
+func setListenerDefaults(config *Configuration) error {
+	if len(config.Listeners) == 0 {
+		if config.Protocol == "" {
+			fmt.Println("No protocol specified, falling back to default: tcp")
+			config.Protocol = "tcp"
+		}
+
+		if config.Port == "" {
+			fmt.Println("No port specified, falling back to default :443")
+			config.Port = ":443"
+		}
+
+		config.Listeners = []Listen{{Name: "main", Protocol: config.Protocol, Address: config.Port}}
+	} else if config.Protocol != "" || config.Port != "" {
+		return fmt.Errorf("protocol and port cannot be combined with listeners")
+	}
+
+	names := make(map[string]bool)
+	served := make(map[string]bool)
+	for i := range config.Listeners {
+		ls := &config.Listeners[i]
+		if ls.Address == "" {
+			return fmt.Errorf("listener %d has no addr", i+1)
+		}
+		if ls.Protocol == "" {
+			ls.Protocol = "tcp"
+		}
+		switch ls.Protocol {
+		case "tcp", "tcp4", "tcp6", "unix", "udp", "udp4", "udp6":
+		default:
+			return fmt.Errorf("unknown protocol '%v' for listener '%v'", ls.Protocol, ls.Address)
+		}
+
+		if ls.Name == "" {
+			ls.Name = ls.Address
+		}
+		if names[ls.Name] || reservedListenerNames[ls.Name] || strings.ContainsAny(ls.Name, ",=") {
+			return fmt.Errorf("invalid or duplicate listener name '%v'", ls.Name)
+		}
+		names[ls.Name] = true
+
+		quic := isPacketProtocol(ls.Protocol)
+		if len(ls.Frontends) == 0 {
+			ls.Frontends = config.frontendOrder
+			if quic {
+				ls.Frontends = nil
+				for _, name := range config.frontendOrder {
+					if quicFrontend(name, config.Frontends[name]) {
+						ls.Frontends = append(ls.Frontends, name)
+					}
+				}
+			}
+		}
+		for _, name := range ls.Frontends {
+			front, ok := config.Frontends[name]
+			if !ok {
+				return fmt.Errorf("listener '%v' names unknown frontend '%v'", ls.Name, name)
+			}
+			if quic && !quicFrontend(name, front) {
+				return fmt.Errorf("QUIC listener '%v' cannot serve frontend '%v', only TLS frontends that are not terminated", ls.Name, name)
+			}
+			served[name] = true
+		}
+		if len(ls.Frontends) == 0 {
+			return fmt.Errorf("listener '%v' serves no frontends", ls.Name)
+		}
+	}
+
+	for _, name := range config.frontendOrder {
+		if !served[name] {
+			return fmt.Errorf("frontend '%v' is not served by any listener", name)
+		}
+	}
+	return nil
+}
+
+func isPacketProtocol(protocol string) bool {
+	return strings.HasPrefix(protocol, "udp")
+}
+
+// quicFrontend reports whether a frontend can be served over QUIC, which
+// tlsmux can only pass through.
+func quicFrontend(name string, front *Frontend) bool {
+	protocol, _ := splitProtocol(name)
+	return protocol == protoTLS && front.TLSCert == "" && front.TLSKey == ""
+}
+
+// muxListener is a listening socket, its muxer and the frontends it serves.
+type muxListener struct {
+	name      string
+	mux       *TLSMuxer
+	frontends map[string]bool
+}
+
+func (ml *muxListener) serves(front *Frontend) bool {
+	return ml.frontends[front.name]
+}
+
+// listenSocket opens a listening socket, replacing a unix socket left behind
+// by a process that is no longer running.
+func listenSocket(network, addr string) (net.Listener, error) {
+	l, err := net.Listen(network, addr)
+	if err == nil || network != "unix" || !errors.Is(err, syscall.EADDRINUSE) {
+		return l, err
+	}
+
+	if conn, dialErr := net.Dial(network, addr); dialErr == nil {
+		conn.Close()
+		return nil, err
+	}
+	if rmErr := os.Remove(addr); rmErr != nil {
+		return nil, err
+	}
+	return net.Listen(network, addr)
+}
+
+// serveListener opens the socket for conf and starts muxing its connections
+// to the frontends it serves.
+func (s *Server) serveListener(conf Listen) (*muxListener, error) {
+	l, err := s.listen(conf.Name, conf.Protocol, conf.Address)
+	if err != nil {
+		return nil, err
+	}
+	s.track(l)
+	s.Info("serving connections", "listener", conf.Name, "addr", l.Addr())
+	l = &countingListener{Listener: l, accepted: s.metrics.accepted.WithLabelValues(conf.Name)}
+
+	if len(s.proxyTrusted) > 0 && !s.Sniff.Proxy {
+		l = &proxyListener{Listener: l, trusted: s.proxyTrusted}
+	}
+
+	ml := &muxListener{name: conf.Name, frontends: make(map[string]bool)}
+	if s.Sniff.enabled() {
+		ml.mux, err = NewSniffingMuxer(l, s.Handshake, &s.nextID, s.Sniff, s.proxyTrusted)
+	} else {
+		ml.mux, err = NewTLSMuxer(l, s.Handshake, &s.nextID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s.sourceRate != nil {
+		ml.mux.SetSourceRateLimit(s.sourceRate)
+	}
+
+	if s.acl != nil {
+		ml.mux.SetACL("", s.acl)
+	}
+
+	targets := make(map[string]*Listener)
+	for _, name := range conf.Frontends {
+		front := s.Frontends[name]
+		fl, err := ml.mux.Listen(name)
+		if err != nil {
+			return nil, err
+		}
+		targets[name] = fl.(*Listener)
+		ml.frontends[name] = true
+		if front.acl != nil {
+			ml.mux.SetACL(name, front.acl)
+		}
+		s.wait.Add(1)
+		go s.frontend(name, front, fl)
+	}
+
+	if s.rules != nil && len(s.rules.rules) > 0 {
+		ml.mux.SetRules(s.rules, targets)
+	}
+
+	s.wait.Add(1)
+	go s.handleMuxErrors(ml)
+	return ml, nil
+}
+
+// handleMuxErrors deals with the connections the listener's muxer could not
+// route until the muxer stops, which it only does once every connection it
+// read has been handed off or reported.
+func (s *Server) handleMuxErrors(ml *muxListener) {
+	defer s.wait.Done()
+
+	for {
+		conn, err := ml.mux.NextError()
+		s.metrics.muxErrors.WithLabelValues(muxErrorType(err)).Inc()
+
+		if conn == nil {
+			if _, ok := err.(Closed); ok {
+				s.Debug("muxer stopped", "listener", ml.name, "err", err)
+				return
+			}
+			s.Error("failed to mux next connection", "listener", ml.name, "err", err)
+			continue
+		}
+
+		if _, ok := err.(NotFound); ok && s.fallback(conn, ml) {
+			continue
+		}
+		if _, ok := err.(Closed); ok {
+			s.Debug("listener closed during handoff", "listener", ml.name, "conn", connID(conn), "remote", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		s.Warn("failed to mux connection", "listener", ml.name, "conn", connID(conn), "remote", conn.RemoteAddr(), "err", err)
+		s.sendAlert(conn, err)
+		conn.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+)
+
+// Logging configures the server's logger. Level is one of debug, info, warn or
+// error and may be overridden per frontend.
+type Logging struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+func (l *Logging) setDefaults() error {
+	if l.Format == "" {
+		l.Format = logFormatLogfmt
+	}
+	if l.Format != logFormatLogfmt && l.Format != logFormatJSON {
+		return fmt.Errorf("log format must be %v or %v", logFormatLogfmt, logFormatJSON)
+	}
+
+	if l.Level == "" {
+		l.Level = "info"
+	}
+	_, err := parseLogLevel(l.Level)
+	return err
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+		return l, fmt.Errorf("invalid log level %q", level)
+	}
+	return l, nil
+}
+
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// connID returns the ID assigned to a connection by Muxer.handle, or zero if
+// it never passed through the muxer.
+func connID(conn net.Conn) uint64 {
+	if m := metaOf(conn); m != nil {
+		return m.id
+	}
+	return 0
+}
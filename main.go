@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"gopkg.in/yaml.v2"
@@ -11,7 +12,9 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 )
 
 const (
@@ -23,28 +26,105 @@ type loadTLSConfigFn func(certPath, keyPath string) (*tls.Config, error)
 type sharedConn struct {
 	sync.Mutex
 	net.Conn
+	m        *connMeta
 	vhostBuf *bytes.Buffer
 }
 
 func newSharedConn(conn net.Conn) (*sharedConn, io.Reader) {
 	c := &sharedConn{
 		Conn:     conn,
+		m:        metaOf(conn),
 		vhostBuf: bytes.NewBuffer(make([]byte, 0, initVhostBufSize)),
 	}
 
 	return c, io.TeeReader(conn, c.vhostBuf)
 }
 
+func (c *sharedConn) meta() *connMeta {
+	return c.m
+}
+
+// Read replays the bytes read while extracting the vhost name before reading
+// from the connection again.
+// The lock only covers the buffer, so a blocked Read does not hold up
+// flushTo or netConn.
+func (c *sharedConn) Read(p []byte) (n int, err error) {
+	c.Lock()
+	if c.vhostBuf != nil {
+		n, _ = c.vhostBuf.Read(p)
+		// end of the peeked bytes: switch to the underlying connection
+		if c.vhostBuf.Len() == 0 {
+			c.vhostBuf = nil
+		}
+	}
+	c.Unlock()
+
+	if n > 0 || len(p) == 0 {
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *sharedConn) flushTo(w io.Writer) (int64, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.vhostBuf == nil {
+		return 0, nil
+	}
+	n, err := c.vhostBuf.WriteTo(w)
+	if err == nil {
+		c.vhostBuf = nil
+	}
+	return n, err
+}
+
+func (c *sharedConn) netConn() net.Conn {
+	c.Lock()
+	defer c.Unlock()
+	if c.vhostBuf != nil {
+		return nil
+	}
+	return c.Conn
+}
+
 type Options struct {
 	configPath string
 }
 
 type Configuration struct {
-	Redirect        bool                 `yaml:"redirect"`
+	Redirect        Redirect             `yaml:"redirect"`
 	Protocol        string               `yaml:"protocol"`
 	Port            string               `yaml:"port"`
+	Listeners       []Listen             `yaml:"listeners"`
 	Frontends       map[string]*Frontend `yaml:"frontends"`
+	SessionTickets  *SessionTickets      `yaml:"session_tickets"`
+	OCSP            *OCSP                `yaml:"ocsp"`
+	AcceptProxy     []string             `yaml:"accept_proxy"`
+	ACL             *ACL                 `yaml:"acl"`
+	RateLimit       *RateLimit           `yaml:"rate_limit"`
+	Handshake       HandshakeLimits      `yaml:"handshake"`
+	Metrics         Metrics              `yaml:"metrics"`
+	Logging         Logging              `yaml:"log"`
+	AccessLog       *AccessLog           `yaml:"access_log"`
+	Tracing         *Tracing             `yaml:"tracing"`
+	Admin           Admin                `yaml:"admin"`
+	DrainTimeout    int                  `yaml:"drain_timeout"`
+	ClientBandwidth *Bandwidth           `yaml:"client_bandwidth"`
+	Fallback        Fallback             `yaml:"fallback"`
+	Alerts          Alerts               `yaml:"alerts"`
+	Rules           []Rule               `yaml:"rules"`
+	Sniff           Sniff                `yaml:"sniff"`
+	frontendOrder   []string
 	defaultFrontend *Frontend
+	fallbacks       *fallbackChain
+	alerts          *alertPolicy
+	rules           *ruleSet
+	acl             *accessList
+	sourceRate      *sourceRateLimiter
+	clientBandwidth *clientBandwidth
+	proxyTrusted    []*net.IPNet
+	ticketKeys      *ticketKeyManager
+	ocsp            *ocspStapler
 }
 
 func parseOpts() (*Options, error) {
@@ -68,14 +148,15 @@ func parseConfiguration(configBuf []byte, loadTLS loadTLSConfigFn) (config *Conf
 		return
 	}
 
-	if config.Protocol == "" {
-		fmt.Println("No protocol specified, falling back to default: tcp")
-		config.Protocol = "tcp"
+	var order struct {
+		Frontends yaml.MapSlice `yaml:"frontends"`
 	}
-
-	if config.Port == "" {
-		fmt.Println("No port specified, falling back to default :443")
-		config.Port = ":443"
+	if err = yaml.Unmarshal(configBuf, &order); err != nil {
+		err = fmt.Errorf("error parsing configuration file: %v", err)
+		return
+	}
+	for _, item := range order.Frontends {
+		config.frontendOrder = append(config.frontendOrder, fmt.Sprint(item.Key))
 	}
 
 	if len(config.Frontends) == 0 {
@@ -83,11 +164,172 @@ func parseConfiguration(configBuf []byte, loadTLS loadTLSConfigFn) (config *Conf
 		return
 	}
 
+	if err = setListenerDefaults(config); err != nil {
+		return
+	}
+
+	if config.SessionTickets != nil {
+		if config.ticketKeys, err = newTicketKeyManager(config.SessionTickets); err != nil {
+			return
+		}
+	}
+
+	if config.OCSP != nil {
+		config.ocsp = newOCSPStapler(config.OCSP)
+	}
+
+	if config.proxyTrusted, err = parseCIDRs(config.AcceptProxy); err != nil {
+		err = fmt.Errorf("invalid accept_proxy source: %v", err)
+		return
+	}
+
+	if config.Sniff.Proxy && len(config.proxyTrusted) == 0 {
+		err = fmt.Errorf("sniff.proxy needs accept_proxy sources")
+		return
+	}
+
+	if config.ACL != nil {
+		if config.acl, err = newAccessList("global ACL", config.ACL); err != nil {
+			return
+		}
+	}
+
+	if err = config.Handshake.setDefaults(); err != nil {
+		return
+	}
+
+	if config.RateLimit != nil {
+		if err = config.RateLimit.validate(); err != nil {
+			return
+		}
+		config.sourceRate = newSourceRateLimiter(config.RateLimit)
+	}
+
+	if err = config.Logging.setDefaults(); err != nil {
+		return
+	}
+
+	if config.Tracing != nil {
+		if err = config.Tracing.setDefaults(); err != nil {
+			return
+		}
+	}
+
+	if config.Redirect.Enabled {
+		if err = config.Redirect.setDefaults(); err != nil {
+			return
+		}
+	}
+
+	if config.DrainTimeout == 0 {
+		config.DrainTimeout = defaultDrainTimeout
+	}
+
+	if config.Metrics.Path == "" {
+		config.Metrics.Path = defaultMetricsPath
+	}
+
+	if config.Fallback.Reject != nil {
+		fmt.Println("fallback.reject is deprecated, use alerts.not_found instead")
+		if config.Alerts.NotFound == "" && !*config.Fallback.Reject {
+			config.Alerts.NotFound = alertNone
+		}
+	}
+	if config.alerts, err = newAlertPolicy(config.Alerts); err != nil {
+		return
+	}
+
+	if config.ClientBandwidth != nil {
+		if err = config.ClientBandwidth.validate(); err != nil {
+			return
+		}
+		config.clientBandwidth = newClientBandwidth(config.ClientBandwidth)
+	}
+
 	for name, front := range config.Frontends {
 		if len(front.Backends) == 0 {
 			err = fmt.Errorf("you must specify at least one backend for frontend '%v'", name)
 			return
 		}
+		front.name = name
+
+		protocol, pattern := splitProtocol(name)
+		switch {
+		case protocol == protoHTTP && !config.Sniff.HTTP, protocol == protoSSH && !config.Sniff.SSH:
+			err = fmt.Errorf("frontend '%v' needs sniff.%v enabled", name, protocol)
+			return
+		case protocol != protoTLS && protocol != protoHTTP && protocol != protoSSH:
+			err = fmt.Errorf("unknown protocol '%v' for frontend '%v'", protocol, name)
+			return
+		case protocol != protoTLS && (front.TLSCert != "" || front.TLSKey != ""):
+			err = fmt.Errorf("frontend '%v' cannot terminate TLS for %v connections", name, protocol)
+			return
+		}
+
+		kind, _, re, routeErr := parseRoute(pattern)
+		if routeErr != nil {
+			err = routeErr
+			return
+		}
+		captures := 1
+		switch kind {
+		case routeWildcard, routeSuffix:
+			captures = 2
+		case routeRegex:
+			captures = re.NumSubexp() + 1
+		}
+
+		if front.HalfCloseTimeout == 0 {
+			front.HalfCloseTimeout = defaultHalfCloseTimeout
+		}
+
+		if front.HandshakeTimeout == 0 {
+			front.HandshakeTimeout = defaultHandshakeTimeout
+		}
+
+		if front.HalfCloseTimeout < 0 || front.IdleTimeout < 0 || front.SessionTimeout < 0 || front.HandshakeTimeout < 0 {
+			err = fmt.Errorf("timeouts must not be negative for frontend '%v'", name)
+			return
+		}
+
+		if front.MinVersion != "" {
+			var ok bool
+			if front.minVersion, ok = tlsVersions[front.MinVersion]; !ok {
+				err = fmt.Errorf("unknown min_version '%v' for frontend '%v'", front.MinVersion, name)
+				return
+			}
+		}
+
+		if front.LogLevel == "" {
+			front.LogLevel = config.Logging.Level
+		}
+		if _, err = parseLogLevel(front.LogLevel); err != nil {
+			err = fmt.Errorf("invalid log level for frontend '%v': %v", name, err)
+			return
+		}
+
+		if front.ACL != nil {
+			if front.acl, err = newAccessList(fmt.Sprintf("ACL for frontend '%v'", name), front.ACL); err != nil {
+				return
+			}
+		}
+
+		if front.RateLimit != nil {
+			if err = front.RateLimit.validate(); err != nil {
+				err = fmt.Errorf("invalid rate limit for frontend '%v': %v", name, err)
+				return
+			}
+			front.rate = newTokenBucket(front.RateLimit)
+		}
+		front.conns = newConnLimiter(front.MaxConnections)
+
+		if front.Bandwidth != nil {
+			if err = front.Bandwidth.validate(); err != nil {
+				err = fmt.Errorf("invalid bandwidth for frontend '%v': %v", name, err)
+				return
+			}
+			front.upload, front.download = newBandwidthBuckets(front.Bandwidth)
+		}
 
 		if front.Default {
 			if config.defaultFrontend != nil {
@@ -97,7 +339,8 @@ func parseConfiguration(configBuf []byte, loadTLS loadTLSConfigFn) (config *Conf
 			config.defaultFrontend = front
 		}
 
-		for _, back := range front.Backends {
+		for i := range front.Backends {
+			back := &front.Backends[i]
 			if back.ConnectTimeout == 0 {
 				back.ConnectTimeout = defaultConnectTimeout
 			}
@@ -110,6 +353,27 @@ func parseConfiguration(configBuf []byte, loadTLS loadTLSConfigFn) (config *Conf
 				err = fmt.Errorf("you must specify an address for each backend on frontend '%v'", name)
 				return
 			}
+
+			back.conns = newConnLimiter(back.MaxConnections)
+			back.state = new(backendState)
+
+			if back.Bandwidth != nil {
+				if err = back.Bandwidth.validate(); err != nil {
+					err = fmt.Errorf("invalid bandwidth for backend '%v' on frontend '%v': %v", back.Address, name, err)
+					return
+				}
+				back.upload, back.download = newBandwidthBuckets(back.Bandwidth)
+			}
+
+			if err = checkAddress(back.Address, captures); err != nil {
+				err = fmt.Errorf("invalid address for backend on frontend '%v': %v", name, err)
+				return
+			}
+
+			if !validProxyVersion(back.SendProxy) {
+				err = fmt.Errorf("send_proxy must be %v or %v for backend '%v' on frontend '%v'", proxyV1, proxyV2, back.Address, name)
+				return
+			}
 		}
 
 		if front.TLSCert != "" || front.TLSKey != "" {
@@ -117,9 +381,31 @@ func parseConfiguration(configBuf []byte, loadTLS loadTLSConfigFn) (config *Conf
 				err = fmt.Errorf("failed to load TLS configuration for frontend '%v': %v", name, err)
 				return
 			}
+
+			if config.ticketKeys != nil {
+				config.ticketKeys.add(front.tlsConfig)
+			}
+
+			if config.ocsp != nil {
+				if err = config.ocsp.add(name, front.tlsConfig); errors.Is(err, errCannotStaple) {
+					fmt.Printf("Not stapling OCSP responses for frontend '%v': %v\n", name, err)
+					err = nil
+				} else if err != nil {
+					err = fmt.Errorf("failed to configure OCSP stapling for frontend '%v': %v", name, err)
+					return
+				}
+			}
 		}
 	}
 
+	if config.rules, err = newRuleSet(config.Rules, config.Frontends); err != nil {
+		return
+	}
+
+	if config.fallbacks, err = newFallbackChain(config.Fallback, config.Frontends, config.defaultFrontend); err != nil {
+		return
+	}
+
 	return
 }
 
@@ -153,11 +439,30 @@ func main() {
 		os.Exit(1)
 	}
 
+	level, _ := parseLogLevel(config.Logging.Level)
 	s := &Server{
 		Configuration: config,
-		Logger:        log.New(os.Stdout, "tlsmux ", log.LstdFlags|log.Lshortfile),
+		Logger:        newLogger(os.Stdout, config.Logging.Format, level),
+		logOutput:     os.Stdout,
 	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			s.Info("received signal", "signal", sig)
+			if sig != syscall.SIGUSR2 {
+				s.Shutdown()
+				continue
+			}
+			go func() {
+				if err := s.Upgrade(); err != nil {
+					s.Error("upgrade failed", "err", err)
+				}
+			}()
+		}
+	}()
+
 	err = s.Run()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to start tlsmux: %v", err)
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFrontendKeys(t *testing.T) {
+	config, err := parseConfiguration([]byte(`
+frontends:
+  example.com:
+    rate_limit: {rate: 5, burst: 10}
+    max_connections: 100
+    log_level: debug
+    half_close_timeout: 1000
+    idle_timeout: 2000
+    session_timeout: 3000
+    handshake_timeout: 4000
+    keep_alive: 5000
+    no_redirect: true
+    backends:
+      - addr: 127.0.0.1:443
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	front := config.Frontends["example.com"]
+	if front.RateLimit == nil || front.RateLimit.Rate != 5 || front.MaxConnections != 100 || front.LogLevel != "debug" ||
+		front.HalfCloseTimeout != 1000 || front.IdleTimeout != 2000 || front.SessionTimeout != 3000 ||
+		front.HandshakeTimeout != 4000 || front.KeepAlive != 5000 || !front.NoRedirect {
+		t.Errorf("frontend settings not read: %+v", front)
+	}
+}
+
+func TestSharedConnReadDoesNotHoldLock(t *testing.T) {
+	client, server := tcpPair(t)
+	c, peek := newSharedConn(server)
+	client.Write([]byte("hello"))
+	if _, err := io.ReadFull(peek, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	if n, err := c.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("replayed %q, %v", buf[:n], err)
+	}
+
+	// a Read blocked on the connection must not hold up netConn
+	read := make(chan string)
+	go func() {
+		n, _ := c.Read(buf)
+		read <- string(buf[:n])
+	}()
+	time.Sleep(50 * time.Millisecond)
+	got := make(chan net.Conn)
+	go func() { got <- c.netConn() }()
+	select {
+	case conn := <-got:
+		if conn == nil {
+			t.Error("netConn is nil after the peeked bytes were read")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("netConn blocked behind Read")
+	}
+
+	client.Write([]byte("world"))
+	if s := <-read; s != "world" {
+		t.Errorf("read %q after the replay, want world", s)
+	}
+}
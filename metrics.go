@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultMetricsPath = "/metrics"
+)
+
+// Metrics configures the Prometheus endpoint. It is only served when Address
+// is set.
+type Metrics struct {
+	Address string `yaml:"addr"`
+	Path    string `yaml:"path"`
+}
+
+type metrics struct {
+	registry *prometheus.Registry
+
+	accepted       *prometheus.CounterVec
+	muxErrors      *prometheus.CounterVec
+	frontendActive *prometheus.GaugeVec
+	backendActive  *prometheus.GaugeVec
+	bytes          *prometheus.CounterVec
+	dialDuration   *prometheus.HistogramVec
+	dialErrors     *prometheus.CounterVec
+	backendUp      *prometheus.GaugeVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		accepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tlsmux_connections_accepted_total",
+			Help: "Connections accepted, or QUIC flows started, by listener.",
+		}, []string{"listener"}),
+		muxErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tlsmux_mux_errors_total",
+			Help: "Connections that could not be routed to a frontend, by error type.",
+		}, []string{"type"}),
+		frontendActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tlsmux_frontend_active_connections",
+			Help: "Connections currently proxied by a frontend.",
+		}, []string{"frontend"}),
+		backendActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tlsmux_backend_active_connections",
+			Help: "Connections currently open to a backend.",
+		}, []string{"frontend", "backend"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tlsmux_bytes_total",
+			Help: "Bytes copied between clients and backends; in is client to backend, out is backend to client.",
+		}, []string{"frontend", "backend", "direction"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tlsmux_backend_dial_duration_seconds",
+			Help:    "Time taken to dial a backend, successful or not.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"frontend", "backend"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "tlsmux_backend_dial_errors_total",
+			Help: "Failed backend dials.",
+		}, []string{"frontend", "backend"}),
+		backendUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tlsmux_backend_up",
+			Help: "Whether the last dial to the backend succeeded.",
+		}, []string{"frontend", "backend"}),
+	}
+
+	m.registry.MustRegister(
+		m.accepted,
+		m.muxErrors,
+		m.frontendActive,
+		m.backendActive,
+		m.bytes,
+		m.dialDuration,
+		m.dialErrors,
+		m.backendUp,
+	)
+	return m
+}
+
+// muxErrorType names the error types sent by Muxer.NextError.
+func muxErrorType(err error) string {
+	switch err.(type) {
+	case NotFound:
+		return "not_found"
+	case BadRequest:
+		return "bad_request"
+	case Forbidden:
+		return "forbidden"
+	case Overloaded:
+		return "overloaded"
+	case Closed:
+		return "closed"
+	}
+	return "other"
+}
+
+// statsCollector exports counters kept by the muxer and the access lists.
+type statsCollector struct {
+	muxes []*muxListener
+	acls  []*accessList
+
+	handshakesDropped *prometheus.Desc
+	aclHits           *prometheus.Desc
+}
+
+func newStatsCollector(muxes []*muxListener, acls []*accessList) *statsCollector {
+	return &statsCollector{
+		muxes: muxes,
+		acls:  acls,
+		handshakesDropped: prometheus.NewDesc(
+			"tlsmux_handshakes_dropped_total",
+			"Connections dropped before their vhost name was read, by listener and reason.",
+			[]string{"listener", "reason"}, nil),
+		aclHits: prometheus.NewDesc(
+			"tlsmux_acl_rule_hits_total",
+			"Connections matched by an access list rule.",
+			[]string{"acl", "rule"}, nil),
+	}
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.handshakesDropped
+	ch <- c.aclHits
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ml := range c.muxes {
+		stats := ml.mux.HandshakeStats()
+		ch <- prometheus.MustNewConstMetric(c.handshakesDropped, prometheus.CounterValue, float64(stats.PoolFull), ml.name, "pool_full")
+		ch <- prometheus.MustNewConstMetric(c.handshakesDropped, prometheus.CounterValue, float64(stats.TimedOut), ml.name, "timeout")
+		ch <- prometheus.MustNewConstMetric(c.handshakesDropped, prometheus.CounterValue, float64(stats.TooSlow), ml.name, "too_slow")
+	}
+
+	for _, acl := range c.acls {
+		seen := make(map[string]bool)
+		for _, rule := range acl.Rules() {
+			if seen[rule.String()] {
+				continue
+			}
+			seen[rule.String()] = true
+			ch <- prometheus.MustNewConstMetric(c.aclHits, prometheus.CounterValue, float64(rule.Hits()), acl.name, rule.String())
+		}
+	}
+}
+
+// countingListener counts the connections accepted by a listener.
+type countingListener struct {
+	net.Listener
+	accepted prometheus.Counter
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Inc()
+	}
+	return conn, err
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
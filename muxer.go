@@ -1,21 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	normalize = strings.ToLower
-	isClosed = func(err error) bool {
-		netErr, ok := err.(net.Error)
-		if ok {
-			return netErr.Temporary()
-		}
-		return false
+	isClosed  = func(err error) bool {
+		return errors.Is(err, net.ErrClosed)
 	}
 )
 
@@ -31,9 +29,18 @@ type Closed struct {
 	error
 }
 
+type Forbidden struct {
+	error
+}
+
+type Overloaded struct {
+	error
+}
+
 type Conn interface {
 	net.Conn
 	Host() string
+	Protocol() string
 	Free()
 }
 
@@ -46,23 +53,31 @@ type (
 	}
 )
 
+// Listener hands out the connections the muxer routed to one name. Closing
+// it never closes accept, so a connection being handed off concurrently is
+// turned back to the muxer instead of panicking.
 type Listener struct {
 	name   string
 	mux    *Muxer
 	accept chan Conn
+	done   chan struct{}
+	closed sync.Once
 }
 
-func (l *Listener) Accept() (net.Conn, error){
-	conn, ok := <- l.accept
-	if !ok {
-		return nil, fmt.Errorf("listener closed")
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, Closed{fmt.Errorf("listener closed")}
 	}
-	return conn, nil
 }
 
 func (l *Listener) Close() error {
-	l.mux.del(l.name)
-	close(l.accept)
+	l.closed.Do(func() {
+		l.mux.del(l.name)
+		close(l.done)
+	})
 	return nil
 }
 
@@ -75,11 +90,24 @@ func (l *Listener) Name() string {
 }
 
 type Muxer struct {
-	listener   net.Listener
-	muxTimeout time.Duration
-	hostFunc   muxFunc
-	muxErrors  chan muxError
-	registry   map[string]*Listener
+	listener      net.Listener
+	muxTimeout    time.Duration
+	minMuxTimeout time.Duration
+	grace         time.Duration
+	minRate       int
+	slots         chan struct{}
+	stats         handshakeStats
+	nextID        *uint64 // shared with the server's other listeners
+	hostFunc      muxFunc
+	muxErrors     chan muxError
+	registry      map[string]*Listener
+	routes        map[string]*routeTable // by protocol
+	rules         *ruleSet
+	targets       map[string]*Listener
+	acls          map[string]*accessList
+	sourceRate    *sourceRateLimiter
+	proxies       []*net.IPNet // sources whose PROXY headers hostFunc reads
+	handling      sync.WaitGroup
 	sync.RWMutex
 }
 
@@ -88,38 +116,61 @@ type TLSMuxer struct {
 }
 
 func (m *TLSMuxer) Listen(name string) (net.Listener, error) {
-	host, _, err := net.SplitHostPort(name)
-	if err != nil {
-		host = name
-	}
-	return m.Muxer.Listen(host)
+	return m.Muxer.Listen(routeName(name))
 }
 
-func NewTLSMuxer(listener net.Listener, muxTimeout time.Duration) (*TLSMuxer, error){
+func (m *TLSMuxer) SetACL(name string, acl *accessList) {
+	m.Muxer.SetACL(routeName(name), acl)
+}
+
+func NewTLSMuxer(listener net.Listener, limits HandshakeLimits, ids *uint64) (*TLSMuxer, error) {
 	fn := func(c net.Conn) (Conn, error) { return TLS(c) }
-	mux, err := NewMuxer(listener, fn, muxTimeout)
+	mux, err := NewMuxer(listener, fn, limits, ids)
 	return &TLSMuxer{mux}, err
 }
 
-func NewMuxer(listener net.Listener, hostFunc muxFunc, muxTimeout time.Duration) (*Muxer, error) {
+// NewMuxer starts muxing the connections accepted by listener. Connection IDs
+// are taken from ids, which every listener of a server shares so that IDs are
+// unique across them.
+func NewMuxer(listener net.Listener, hostFunc muxFunc, limits HandshakeLimits, ids *uint64) (*Muxer, error) {
 	mux := &Muxer{
-		listener:   listener,
-		muxTimeout: muxTimeout,
-		hostFunc:   hostFunc,
-		muxErrors:  make(chan muxError),
-		registry:   make(map[string]*Listener),
+		listener:      listener,
+		muxTimeout:    time.Duration(limits.Timeout) * time.Millisecond,
+		minMuxTimeout: time.Duration(limits.MinTimeout) * time.Millisecond,
+		grace:         time.Duration(limits.Grace) * time.Millisecond,
+		minRate:       limits.MinRate,
+		slots:         make(chan struct{}, limits.MaxInFlight),
+		nextID:        ids,
+		hostFunc:      hostFunc,
+		muxErrors:     make(chan muxError),
+		registry:      make(map[string]*Listener),
+		routes:        make(map[string]*routeTable),
+		acls:          make(map[string]*accessList),
 	}
 
 	go mux.run()
 	return mux, nil
 }
 
-func (m *Muxer) NextError() (net.Conn, error){
-	muxError := <- m.muxErrors
+// HandshakeStats returns the number of connections dropped before their vhost
+// name could be read.
+func (m *Muxer) HandshakeStats() HandshakeStats {
+	return m.stats.snapshot()
+}
+
+// handshakeTimeout shrinks linearly from muxTimeout to minMuxTimeout as the
+// pool of in-flight handshakes fills up.
+func (m *Muxer) handshakeTimeout() time.Duration {
+	load := float64(len(m.slots)) / float64(cap(m.slots))
+	return m.muxTimeout - time.Duration(load*float64(m.muxTimeout-m.minMuxTimeout))
+}
+
+func (m *Muxer) NextError() (net.Conn, error) {
+	muxError := <-m.muxErrors
 	return muxError.conn, muxError.err
 }
 
-func (m *Muxer) sendError(conn net.Conn, err error){
+func (m *Muxer) sendError(conn net.Conn, err error) {
 	m.muxErrors <- muxError{conn: conn, err: err}
 }
 
@@ -129,75 +180,209 @@ func (m *Muxer) set(name string, l *Listener) error {
 	if _, exists := m.registry[name]; exists {
 		return fmt.Errorf("name %s is already bound", name)
 	}
+	protocol, pattern := splitProtocol(name)
+	routes, ok := m.routes[protocol]
+	if !ok {
+		routes = new(routeTable)
+		m.routes[protocol] = routes
+	}
+	if err := routes.add(pattern, l); err != nil {
+		return err
+	}
 	m.registry[name] = l
 	return nil
 }
 
-func (m *Muxer) get(name string) (l *Listener, ok bool){
+// get finds the listener for a protocol's name and the parts of the name
+// captured by its route.
+func (m *Muxer) get(protocol, name string) (l *Listener, captures []string, ok bool) {
 	m.RLock()
 	defer m.RUnlock()
-	l, ok = m.registry[name]
+	routes, ok := m.routes[protocol]
 	if !ok {
-		parts := strings.Split(name, ".")
-		for i := 0; i < len(parts)-1; i++ {
-			parts[i] = "*"
-			name = strings.Join(parts[i:], ".")
-			l, ok = m.registry[name]
-			if ok {
-				break
-			}
-		}
+		return nil, nil, false
 	}
-	return
+	l, captures = routes.match(name)
+	return l, captures, l != nil
+}
+
+// SetACL restricts the clients allowed to reach name. The empty name applies
+// to every connection and is checked before the vhost name is read.
+func (m *Muxer) SetACL(name string, acl *accessList) {
+	m.Lock()
+	defer m.Unlock()
+	m.acls[routeName(name)] = acl
+}
+
+// SetRules routes connections matching one of rules to the listener targets
+// has for the rule's frontend, whatever their vhost name.
+func (m *Muxer) SetRules(rules *ruleSet, targets map[string]*Listener) {
+	m.Lock()
+	defer m.Unlock()
+	m.rules = rules
+	m.targets = targets
+}
+
+// matchRule returns the listener of the first rule matching conn, or nil.
+func (m *Muxer) matchRule(conn Conn) *Listener {
+	m.RLock()
+	rules, targets := m.rules, m.targets
+	m.RUnlock()
+	if rules == nil {
+		return nil
+	}
+	served := func(frontend string) bool { return targets[frontend] != nil }
+	if r := rules.match(ruleInputOf(conn), served); r != nil {
+		return targets[r.frontend]
+	}
+	return nil
+}
+
+// SetSourceRateLimit limits how often a single client IP may connect.
+func (m *Muxer) SetSourceRateLimit(l *sourceRateLimiter) {
+	m.Lock()
+	defer m.Unlock()
+	m.sourceRate = l
+}
+
+func (m *Muxer) checkSourceRate(conn net.Conn) error {
+	m.RLock()
+	l := m.sourceRate
+	m.RUnlock()
+	return l.check(conn.RemoteAddr())
+}
+
+// SetProxies names the sources whose connections may start with a PROXY
+// header that hostFunc reads.
+func (m *Muxer) SetProxies(trusted []*net.IPNet) {
+	m.Lock()
+	defer m.Unlock()
+	m.proxies = trusted
+}
+
+// checkSource applies the listener-wide access list and rate limit.
+func (m *Muxer) checkSource(conn net.Conn) error {
+	if err := m.checkACL("", conn); err != nil {
+		return err
+	}
+	return m.checkSourceRate(conn)
+}
+
+func (m *Muxer) checkACL(name string, conn net.Conn) error {
+	m.RLock()
+	acl := m.acls[name]
+	m.RUnlock()
+	return acl.check(conn.RemoteAddr())
 }
 
 func (m *Muxer) del(name string) {
 	m.Lock()
 	defer m.Unlock()
 	delete(m.registry, name)
+	protocol, pattern := splitProtocol(name)
+	if routes, ok := m.routes[protocol]; ok {
+		routes.remove(pattern)
+	}
 }
 
 func (m *Muxer) handle(conn net.Conn) {
+	defer m.handling.Done()
 	defer func() {
 		if r := recover(); r != nil {
 			m.sendError(conn, fmt.Errorf("NameMux.handle failed with err %v", r))
 		}
 	}()
+	defer func() { <-m.slots }()
+
+	// the ID comes first so that every log line about the connection,
+	// including rejections, carries it
+	deadline := time.Now().Add(m.handshakeTimeout())
+	hconn := &handshakeConn{
+		Conn: conn,
+		m: &connMeta{
+			id:       atomic.AddUint64(m.nextID, 1),
+			accepted: time.Now(),
+		},
+		deadline: deadline,
+		grace:    m.grace,
+		minRate:  m.minRate,
+	}
 
-	if err := conn.SetDeadline(time.Now().Add(m.muxTimeout)); err != nil {
-		m.sendError(conn, fmt.Errorf("failed to set deadline: %v", err))
+	if err := conn.SetDeadline(deadline); err != nil {
+		m.sendError(hconn, fmt.Errorf("failed to set deadline: %v", err))
 		return
 	}
 
-	vconn, err := m.hostFunc(conn)
+	// a trusted proxy may still replace its own address with the client's,
+	// so its connections are checked once the vhost name has been read
+	m.RLock()
+	proxied := isTrusted(m.proxies, conn.RemoteAddr())
+	m.RUnlock()
+	if !proxied {
+		if err := m.checkSource(hconn); err != nil {
+			m.sendError(hconn, err)
+			return
+		}
+	}
+
+	vconn, err := m.hostFunc(hconn)
+	hconn.finish()
+	hconn.m.sniffed = time.Now()
 	if err != nil {
-		m.sendError(conn, BadRequest{fmt.Errorf("failed to extra vhost name: %v", err)})
+		if hconn.expired && hconn.slow {
+			atomic.AddUint64(&m.stats.tooSlow, 1)
+		} else if hconn.expired {
+			atomic.AddUint64(&m.stats.timedOut, 1)
+		}
+		m.sendError(hconn, BadRequest{fmt.Errorf("failed to extra vhost name: %w", err)})
 		return
 	}
 
+	if proxied {
+		if err := m.checkSource(vconn); err != nil {
+			m.sendError(vconn, err)
+			return
+		}
+	}
+
 	host := normalize(vconn.Host())
 
-	l, ok := m.get(host)
-	if !ok  {
+	l, captures, ok := m.get(vconn.Protocol(), host)
+	if target := m.matchRule(vconn); target != nil {
+		l, captures, ok = target, []string{host}, true
+	}
+	if !ok {
 		m.sendError(vconn, NotFound{fmt.Errorf("host not found: %v", host)})
 		return
 	}
 
+	if err = m.checkACL(l.name, vconn); err != nil {
+		m.sendError(vconn, err)
+		return
+	}
+	hconn.m.routed = time.Now()
+	hconn.m.captures = captures
+
 	if err = vconn.SetDeadline(time.Time{}); err != nil {
 		m.sendError(vconn, fmt.Errorf("failed unset connection deadline: %v", err))
 		return
 	}
 
-	l.accept <- vconn
+	select {
+	case l.accept <- vconn:
+	case <-l.done:
+		m.sendError(vconn, Closed{fmt.Errorf("listener %v closed", l.name)})
+	}
 }
 
-func (m *Muxer) Listen(name string) (net.Listener, error){
-	name = normalize(name)
+func (m *Muxer) Listen(name string) (net.Listener, error) {
+	name = routeName(name)
 
 	vhost := &Listener{
-		name: name,
-		mux: m,
+		name:   name,
+		mux:    m,
 		accept: make(chan Conn),
+		done:   make(chan struct{}),
 	}
 
 	if err := m.set(name, vhost); err != nil {
@@ -207,11 +392,29 @@ func (m *Muxer) Listen(name string) (net.Listener, error){
 	return vhost, nil
 }
 
+// close runs once the muxer's listener is closed. It lets the connections
+// being read finish their handoff, then closes every name's listener.
+func (m *Muxer) close() {
+	m.handling.Wait()
+
+	m.RLock()
+	listeners := make([]*Listener, 0, len(m.registry))
+	for _, l := range m.registry {
+		listeners = append(listeners, l)
+	}
+	m.RUnlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
 func (m *Muxer) run() {
 	for {
 		conn, err := m.listener.Accept()
 		if err != nil {
 			if isClosed(err) {
+				m.close()
 				m.sendError(nil, Closed{err})
 				return
 			} else {
@@ -219,6 +422,14 @@ func (m *Muxer) run() {
 				continue
 			}
 		}
-		go m.handle(conn)
+
+		select {
+		case m.slots <- struct{}{}:
+			m.handling.Add(1)
+			go m.handle(conn)
+		default:
+			atomic.AddUint64(&m.stats.poolFull, 1)
+			conn.Close()
+		}
 	}
 }
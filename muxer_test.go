@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestMuxer starts a TLS muxer on a loopback port.
+func newTestMuxer(t *testing.T) *TLSMuxer {
+	t.Helper()
+	return newTestMuxerWithIDs(t, new(uint64))
+}
+
+// newTestMuxerWithIDs is like newTestMuxer but takes connection IDs from ids.
+func newTestMuxerWithIDs(t *testing.T, ids *uint64) *TLSMuxer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := HandshakeLimits{}
+	if err := limits.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	mux, err := NewTLSMuxer(l, limits, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return mux
+}
+
+// nextError waits for the muxer to give up on a connection.
+func nextError(t *testing.T, mux *TLSMuxer) (net.Conn, error) {
+	t.Helper()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := mux.NextError()
+		ch <- result{conn, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error from the muxer")
+	}
+	return nil, nil
+}
+
+func TestRejectedConnectionHasID(t *testing.T) {
+	mux := newTestMuxer(t)
+	acl, err := newAccessList("test", &ACL{Deny: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.SetACL("", acl)
+
+	c, err := net.Dial("tcp", mux.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn, err := nextError(t, mux)
+	if _, ok := err.(Forbidden); !ok {
+		t.Fatalf("got %v, want Forbidden", err)
+	}
+	if connID(conn) == 0 {
+		t.Error("rejected connection has no ID")
+	}
+}
+
+func TestConnectionIDsSharedAcrossMuxers(t *testing.T) {
+	acl, err := newAccessList("test", &ACL{Deny: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids uint64
+	seen := make(map[uint64]bool)
+	for i := 0; i < 2; i++ {
+		mux := newTestMuxerWithIDs(t, &ids)
+		mux.SetACL("", acl)
+
+		c, err := net.Dial("tcp", mux.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		conn, _ := nextError(t, mux)
+		id := connID(conn)
+		if seen[id] {
+			t.Errorf("muxer %v reused connection ID %v", i, id)
+		}
+		seen[id] = true
+	}
+}
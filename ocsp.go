@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultOCSPTimeout = 10000 // milliseconds
+	ocspRetryInterval  = 5 * time.Minute
+	ocspMinRefresh     = time.Minute
+	ocspDefaultRefresh = time.Hour // for responses without a next update
+)
+
+// errCannotStaple is returned by ocspStapler.add for certificates that can
+// be served, just not stapled.
+var errCannotStaple = errors.New("cannot staple OCSP responses")
+
+// OCSP configures stapling for frontends that terminate TLS. Responder
+// overrides the URL from the certificate, which is mostly useful for testing
+// against a local responder.
+type OCSP struct {
+	CacheDir  string `yaml:"cache_dir"`
+	Responder string `yaml:"responder"`
+	Timeout   int    `yaml:"timeout"`
+}
+
+type ocspStapler struct {
+	*OCSP
+	client   *http.Client
+	staplers []*certStapler
+}
+
+// certStapler keeps the OCSP staple of a single certificate fresh and hands
+// out copies of the certificate with the current staple attached.
+type certStapler struct {
+	sync.RWMutex
+	name   string
+	cert   tls.Certificate
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+	resp   *ocsp.Response
+}
+
+func newOCSPStapler(conf *OCSP) *ocspStapler {
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultOCSPTimeout
+	}
+
+	return &ocspStapler{
+		OCSP:   conf,
+		client: &http.Client{Timeout: time.Duration(conf.Timeout) * time.Millisecond},
+	}
+}
+
+// add takes over certificate selection for config so that every handshake
+// sees the latest staple. Certificates without an issuer in their chain or
+// without a responder are left alone and errCannotStaple is returned.
+func (o *ocspStapler) add(name string, config *tls.Config) error {
+	if len(config.Certificates) == 0 {
+		return nil
+	}
+
+	cert := config.Certificates[0]
+	if len(cert.Certificate) < 2 {
+		return fmt.Errorf("%w: certificate for '%v' has no issuer in its chain", errCannotStaple, name)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return err
+	}
+
+	if len(leaf.OCSPServer) == 0 && o.Responder == "" {
+		return fmt.Errorf("%w: certificate for '%v' has no OCSP responder", errCannotStaple, name)
+	}
+
+	c := &certStapler{name: name, cert: cert, leaf: leaf, issuer: issuer}
+	if o.CacheDir != "" {
+		if raw, err := ioutil.ReadFile(o.cachePath(c)); err == nil {
+			c.set(raw, time.Now())
+		}
+	}
+
+	config.Certificates = nil
+	config.GetCertificate = c.getCertificate
+	o.staplers = append(o.staplers, c)
+	return nil
+}
+
+func (o *ocspStapler) cachePath(c *certStapler) string {
+	sum := sha256.Sum256(c.leaf.Raw)
+	return filepath.Join(o.CacheDir, hex.EncodeToString(sum[:])+".ocsp")
+}
+
+func (o *ocspStapler) run(logger *slog.Logger) {
+	for _, c := range o.staplers {
+		go o.refresh(c, logger)
+	}
+}
+
+func (o *ocspStapler) refresh(c *certStapler, logger *slog.Logger) {
+	for {
+		wait := c.nextRefresh(time.Now())
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+
+		raw, err := o.fetch(c)
+		if err == nil {
+			err = c.set(raw, time.Now())
+		}
+		if err != nil {
+			logger.Error("failed to refresh OCSP staple", "frontend", c.name, "err", err)
+			time.Sleep(ocspRetryInterval)
+			continue
+		}
+		logger.Info("refreshed OCSP staple", "frontend", c.name, "next_update", c.resp.NextUpdate)
+
+		if o.CacheDir != "" {
+			if err = ioutil.WriteFile(o.cachePath(c), raw, 0644); err != nil {
+				logger.Error("failed to persist OCSP staple", "frontend", c.name, "err", err)
+			}
+		}
+	}
+}
+
+func (o *ocspStapler) fetch(c *certStapler) ([]byte, error) {
+	req, err := ocsp.CreateRequest(c.leaf, c.issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	url := o.Responder
+	if url == "" {
+		url = c.leaf.OCSPServer[0]
+	}
+
+	resp, err := o.client.Post(url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder %v returned %v", url, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// set validates raw against the certificate and, if it is a current good
+// response, makes it the staple.
+func (c *certStapler) set(raw []byte, now time.Time) error {
+	resp, err := ocsp.ParseResponseForCert(raw, c.leaf, c.issuer)
+	if err != nil {
+		return err
+	}
+
+	if resp.Status != ocsp.Good {
+		return fmt.Errorf("certificate status is %v", resp.Status)
+	}
+
+	if !resp.NextUpdate.IsZero() && !now.Before(resp.NextUpdate) {
+		return fmt.Errorf("response expired at %v", resp.NextUpdate)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.resp = resp
+	c.cert.OCSPStaple = raw
+	return nil
+}
+
+// nextRefresh returns how long to wait before fetching a new response: half
+// way through the validity window of the current one, or an hour if it does
+// not say when the next update is due.
+func (c *certStapler) nextRefresh(now time.Time) time.Duration {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.resp == nil {
+		return 0
+	}
+	if c.resp.NextUpdate.IsZero() {
+		return ocspDefaultRefresh
+	}
+
+	at := c.resp.ThisUpdate.Add(c.resp.NextUpdate.Sub(c.resp.ThisUpdate) / 2)
+	if wait := at.Sub(now); wait > ocspMinRefresh {
+		return wait
+	}
+	return ocspMinRefresh
+}
+
+func (c *certStapler) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	cert := c.cert
+	if c.resp != nil && !c.resp.NextUpdate.IsZero() && time.Now().After(c.resp.NextUpdate) {
+		cert.OCSPStaple = nil
+	}
+	return &cert, nil
+}
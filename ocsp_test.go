@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponder answers every request with the given status and validity.
+func ocspResponder(t *testing.T, ca *testCA, status int, validity time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tmpl := ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+		}
+		if validity > 0 {
+			tmpl.NextUpdate = tmpl.ThisUpdate.Add(validity)
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, tmpl, ca.key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Write(resp)
+	}))
+}
+
+func TestOCSPStaple(t *testing.T) {
+	ca := newTestCA(t)
+	responder := ocspResponder(t, ca, ocsp.Good, 4*time.Hour)
+	defer responder.Close()
+
+	o := newOCSPStapler(&OCSP{})
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, responder.URL, "example.com")}}
+	if err := o.add("example.com", config); err != nil {
+		t.Fatal(err)
+	}
+	c := o.staplers[0]
+
+	if wait := c.nextRefresh(time.Now()); wait != 0 {
+		t.Errorf("refresh without a staple in %v, want right away", wait)
+	}
+
+	raw, err := o.fetch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.set(raw, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.OCSPStaple) == 0 {
+		t.Error("no staple served")
+	}
+
+	if wait := c.nextRefresh(time.Now()); wait < time.Hour || wait > 2*time.Hour {
+		t.Errorf("refresh in %v, want half way through the validity", wait)
+	}
+}
+
+func TestOCSPWithoutNextUpdate(t *testing.T) {
+	ca := newTestCA(t)
+	responder := ocspResponder(t, ca, ocsp.Good, 0)
+	defer responder.Close()
+
+	o := newOCSPStapler(&OCSP{})
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, responder.URL, "example.com")}}
+	if err := o.add("example.com", config); err != nil {
+		t.Fatal(err)
+	}
+	c := o.staplers[0]
+
+	raw, err := o.fetch(c)
+	if err == nil {
+		err = c.set(raw, time.Now())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wait := c.nextRefresh(time.Now()); wait != ocspDefaultRefresh {
+		t.Errorf("refresh in %v, want %v", wait, ocspDefaultRefresh)
+	}
+}
+
+func TestOCSPRevoked(t *testing.T) {
+	ca := newTestCA(t)
+	responder := ocspResponder(t, ca, ocsp.Revoked, time.Hour)
+	defer responder.Close()
+
+	o := newOCSPStapler(&OCSP{})
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, responder.URL, "example.com")}}
+	if err := o.add("example.com", config); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := o.fetch(o.staplers[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o.staplers[0].set(raw, time.Now()); err == nil {
+		t.Error("revoked response accepted as staple")
+	}
+}
+
+func TestOCSPCannotStaple(t *testing.T) {
+	ca := newTestCA(t)
+	o := newOCSPStapler(&OCSP{})
+
+	noResponder := ca.issue(t, "", "example.com")
+	noIssuer := ca.issue(t, "http://127.0.0.1:1", "example.com")
+	noIssuer.Certificate = noIssuer.Certificate[:1]
+
+	for name, cert := range map[string]tls.Certificate{"no responder": noResponder, "no issuer": noIssuer} {
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if err := o.add(name, config); !errors.Is(err, errCannotStaple) {
+			t.Errorf("%v: got %v, want errCannotStaple", name, err)
+		}
+		if len(config.Certificates) != 1 || config.GetCertificate != nil {
+			t.Errorf("%v: certificate selection taken over", name)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	proxyV1 = "v1"
+	proxyV2 = "v2"
+
+	proxyV2VersionProxy uint8 = 0x21 // version 2, PROXY command
+	proxyV2FamilyUnspec uint8 = 0x00
+	proxyV2FamilyTCP4   uint8 = 0x11
+	proxyV2FamilyTCP6   uint8 = 0x21
+
+	proxyV2TypeALPN       uint8 = 0x01
+	proxyV2TypeAuthority  uint8 = 0x02
+	proxyV2TypeSSL        uint8 = 0x20
+	proxyV2SubtypeVersion uint8 = 0x21
+
+	proxyV2ClientSSL uint8 = 0x01
+
+	// proxyV2VerifyNone is the non-zero verify result sent in the SSL TLV:
+	// zero would claim a verified client certificate, which is never checked
+	proxyV2VerifyNone uint32 = 1
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionSSL30: "SSLv3",
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// proxyInfo carries the TLS details sent to backends in PROXY v2 TLVs. Zero
+// values are left out of the header.
+type proxyInfo struct {
+	ServerName string
+	ALPN       string
+	Version    uint16
+}
+
+func validProxyVersion(version string) bool {
+	return version == "" || version == proxyV1 || version == proxyV2
+}
+
+// writeProxyHeader writes a PROXY protocol header describing a connection
+// from src to dst.
+func writeProxyHeader(w io.Writer, version string, src, dst net.Addr, info proxyInfo) error {
+	var header []byte
+	switch version {
+	case proxyV1:
+		header = proxyV1Header(src, dst)
+	case proxyV2:
+		header = proxyV2Header(src, dst, info)
+	default:
+		return fmt.Errorf("unknown PROXY protocol version %q", version)
+	}
+
+	_, err := w.Write(header)
+	return err
+}
+
+func proxyV1Header(src, dst net.Addr) []byte {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	if srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcAddr.IP.To4(), dstAddr.IP.To4(), srcAddr.Port, dstAddr.Port))
+	}
+
+	// both addresses must be of the same family, so an IPv4 one is written
+	// in its IPv4-mapped IPv6 form
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyV1IPv6(srcAddr.IP), proxyV1IPv6(dstAddr.IP), srcAddr.Port, dstAddr.Port))
+}
+
+// proxyV1IPv6 formats ip as an IPv6 address, which net.IP does not do for
+// IPv4-mapped ones.
+func proxyV1IPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func proxyV2Header(src, dst net.Addr, info proxyInfo) []byte {
+	var addrs bytes.Buffer
+	family := proxyV2FamilyUnspec
+
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	if srcOk && dstOk {
+		srcIP, dstIP := srcAddr.IP.To4(), dstAddr.IP.To4()
+		family = proxyV2FamilyTCP4
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+			family = proxyV2FamilyTCP6
+		}
+		addrs.Write(srcIP)
+		addrs.Write(dstIP)
+		binary.Write(&addrs, binary.BigEndian, uint16(srcAddr.Port))
+		binary.Write(&addrs, binary.BigEndian, uint16(dstAddr.Port))
+	}
+
+	var tlvs bytes.Buffer
+	if info.ALPN != "" {
+		writeTLV(&tlvs, proxyV2TypeALPN, []byte(info.ALPN))
+	}
+	if info.ServerName != "" {
+		writeTLV(&tlvs, proxyV2TypeAuthority, []byte(info.ServerName))
+	}
+	if name, ok := tlsVersionNames[info.Version]; ok {
+		var ssl bytes.Buffer
+		ssl.WriteByte(proxyV2ClientSSL) // TLS, but no client certificate
+		binary.Write(&ssl, binary.BigEndian, proxyV2VerifyNone)
+		writeTLV(&ssl, proxyV2SubtypeVersion, []byte(name))
+		writeTLV(&tlvs, proxyV2TypeSSL, ssl.Bytes())
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyV2Signature)
+	header.WriteByte(proxyV2VersionProxy)
+	header.WriteByte(family)
+	binary.Write(&header, binary.BigEndian, uint16(addrs.Len()+tlvs.Len()))
+	header.Write(addrs.Bytes())
+	header.Write(tlvs.Bytes())
+	return header.Bytes()
+}
+
+func writeTLV(b *bytes.Buffer, typ uint8, value []byte) {
+	b.WriteByte(typ)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.Write(value)
+}
+
+const (
+	proxyV1MaxLen        = 107 // including the trailing CRLF
+	proxyV2HeaderLen     = 16
+	proxyV2CommandLocal  = 0x20
+	proxyV2AddrsLenTCP4  = 12
+	proxyV2AddrsLenTCP6  = 36
+	proxyV2MaxPayloadLen = 4096
+)
+
+// proxyListener accepts PROXY protocol headers from trusted sources. The
+// header is read lazily by the first Read or RemoteAddr call on the accepted
+// connection, so that it happens under the same deadline as the ClientHello
+// read in Muxer.handle rather than in the accept loop.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isTrusted(l.trusted, conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn}, nil
+}
+
+// isTrusted reports whether addr may send PROXY headers.
+func isTrusted(trusted []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn reports the addresses from the PROXY header it was prefixed with.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.remote, c.local, c.err = readProxyHeader(c.Conn)
+		if c.err != nil {
+			c.err = fmt.Errorf("invalid PROXY header from %v: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) netConn() net.Conn {
+	if c.init(); c.err != nil {
+		return nil
+	}
+	return c.Conn
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.init(); c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader consumes a v1 or v2 header from r without reading past it.
+// Nil addresses mean the header did not carry any (UNKNOWN, LOCAL or an
+// unsupported family) and the connection's own should be used.
+func readProxyHeader(r io.Reader) (src, dst net.Addr, err error) {
+	buf := make([]byte, proxyV2HeaderLen)
+	if _, err = io.ReadFull(r, buf[:6]); err != nil {
+		return
+	}
+
+	switch {
+	case string(buf[:6]) == "PROXY ":
+		return readProxyV1(r)
+	case bytes.Equal(buf[:6], proxyV2Signature[:6]):
+		if _, err = io.ReadFull(r, buf[6:]); err != nil {
+			return
+		}
+		return readProxyV2(r, buf)
+	}
+
+	return nil, nil, fmt.Errorf("missing PROXY protocol signature")
+}
+
+func readProxyV1(r io.Reader) (src, dst net.Addr, err error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	b := make([]byte, 1)
+	for {
+		if _, err = io.ReadFull(r, b); err != nil {
+			return
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) > proxyV1MaxLen-6 {
+			return nil, nil, fmt.Errorf("v1 header too long")
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	srcAddr, err := parseProxyV1Addr(fields[1], fields[3])
+	if err != nil {
+		return
+	}
+	dstAddr, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return
+	}
+	return srcAddr, dstAddr, nil
+}
+
+func parseProxyV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2(r io.Reader, header []byte) (src, dst net.Addr, err error) {
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, nil, fmt.Errorf("invalid v2 signature")
+	}
+
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+
+	n := int(binary.BigEndian.Uint16(header[14:16]))
+	if n > proxyV2MaxPayloadLen {
+		return nil, nil, fmt.Errorf("v2 header too long")
+	}
+
+	payload := make([]byte, n)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+
+	if verCmd == proxyV2CommandLocal {
+		return nil, nil, nil
+	}
+
+	switch family {
+	case proxyV2FamilyTCP4:
+		if n < proxyV2AddrsLenTCP4 {
+			return nil, nil, fmt.Errorf("short v2 TCP4 addresses")
+		}
+		src = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		dst = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case proxyV2FamilyTCP6:
+		if n < proxyV2AddrsLenTCP6 {
+			return nil, nil, fmt.Errorf("short v2 TCP6 addresses")
+		}
+		src = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		dst = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	}
+
+	return
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
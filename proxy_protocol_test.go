@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func tcpAddr(ip string, port int) *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func sameAddr(a net.Addr, b *net.TCPAddr) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	t, ok := a.(*net.TCPAddr)
+	return ok && t.IP.Equal(b.IP) && t.Port == b.Port
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	unix := &net.UnixAddr{Name: "/run/tlsmux.sock", Net: "unix"}
+	for _, tt := range []struct {
+		name     string
+		src, dst net.Addr
+		v1       string
+		want     bool // whether the addresses are carried
+	}{
+		{"tcp4", tcpAddr("192.0.2.1", 1234), tcpAddr("10.0.0.2", 443), "PROXY TCP4 192.0.2.1 10.0.0.2 1234 443\r\n", true},
+		{"tcp6", tcpAddr("2001:db8::1", 1234), tcpAddr("::1", 443), "PROXY TCP6 2001:db8::1 ::1 1234 443\r\n", true},
+		{"mixed", tcpAddr("::1", 1234), tcpAddr("10.0.0.2", 443), "PROXY TCP6 ::1 ::ffff:10.0.0.2 1234 443\r\n", true},
+		{"unknown", unix, unix, "PROXY UNKNOWN\r\n", false},
+	} {
+		for _, version := range []string{proxyV1, proxyV2} {
+			var buf bytes.Buffer
+			if err := writeProxyHeader(&buf, version, tt.src, tt.dst, proxyInfo{}); err != nil {
+				t.Fatal(err)
+			}
+			if version == proxyV1 && buf.String() != tt.v1 {
+				t.Errorf("%v v1 header is %q, want %q", tt.name, buf.String(), tt.v1)
+			}
+
+			buf.WriteString("rest")
+			src, dst, err := readProxyHeader(&buf)
+			if err != nil {
+				t.Errorf("%v %v: %v", tt.name, version, err)
+				continue
+			}
+			if tt.want {
+				if !sameAddr(src, tt.src.(*net.TCPAddr)) || !sameAddr(dst, tt.dst.(*net.TCPAddr)) {
+					t.Errorf("%v %v: read %v and %v, want %v and %v", tt.name, version, src, dst, tt.src, tt.dst)
+				}
+			} else if src != nil || dst != nil {
+				t.Errorf("%v %v: read %v and %v, want none", tt.name, version, src, dst)
+			}
+			if rest, _ := io.ReadAll(&buf); string(rest) != "rest" {
+				t.Errorf("%v %v: %q left after the header", tt.name, version, rest)
+			}
+		}
+	}
+}
+
+func TestProxyV2TLVs(t *testing.T) {
+	var buf bytes.Buffer
+	info := proxyInfo{ServerName: "example.com", ALPN: "h2", Version: tls.VersionTLS13}
+	if err := writeProxyHeader(&buf, proxyV2, tcpAddr("192.0.2.1", 1234), tcpAddr("10.0.0.2", 443), info); err != nil {
+		t.Fatal(err)
+	}
+
+	tlvs := buf.Bytes()[proxyV2HeaderLen+proxyV2AddrsLenTCP4:]
+	found := make(map[uint8][]byte)
+	for len(tlvs) >= 3 {
+		n := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		found[tlvs[0]] = tlvs[3 : 3+n]
+		tlvs = tlvs[3+n:]
+	}
+
+	if v := string(found[proxyV2TypeALPN]); v != "h2" {
+		t.Errorf("ALPN TLV is %q", v)
+	}
+	if v := string(found[proxyV2TypeAuthority]); v != "example.com" {
+		t.Errorf("authority TLV is %q", v)
+	}
+	ssl := found[proxyV2TypeSSL]
+	if len(ssl) < 5 {
+		t.Fatalf("SSL TLV is %x", ssl)
+	}
+	if ssl[0] != proxyV2ClientSSL {
+		t.Errorf("SSL client flags are %#x, want only the TLS one", ssl[0])
+	}
+	if verify := binary.BigEndian.Uint32(ssl[1:5]); verify == 0 {
+		t.Error("SSL TLV claims a verified client certificate")
+	}
+	if v := string(ssl[8:]); ssl[5] != proxyV2SubtypeVersion || v != "TLSv1.3" {
+		t.Errorf("SSL version sub-TLV is %x", ssl[5:])
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	v2 := func(verCmd, family byte, length uint16, payload []byte) []byte {
+		b := append([]byte(nil), proxyV2Signature...)
+		b = append(b, verCmd, family, byte(length>>8), byte(length))
+		return append(b, payload...)
+	}
+
+	for name, header := range map[string][]byte{
+		"no signature":    []byte("GET / HTTP/1.1\r\n"),
+		"v1 truncated":    []byte("PROXY TCP4 192.0.2.1 10.0.0.2 1234"),
+		"v1 without CR":   []byte("PROXY TCP4 192.0.2.1 10.0.0.2 1234 443\n"),
+		"v1 too long":     append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), proxyV1MaxLen)...),
+		"v1 fields":       []byte("PROXY TCP4 192.0.2.1 10.0.0.2 1234\r\n"),
+		"v1 family":       []byte("PROXY UDP4 192.0.2.1 10.0.0.2 1234 443\r\n"),
+		"v1 address":      []byte("PROXY TCP4 192.0.2.300 10.0.0.2 1234 443\r\n"),
+		"v1 port":         []byte("PROXY TCP4 192.0.2.1 10.0.0.2 1234 65536\r\n"),
+		"v2 truncated":    v2(proxyV2VersionProxy, proxyV2FamilyTCP4, proxyV2AddrsLenTCP4, make([]byte, 4)),
+		"v2 oversized":    v2(proxyV2VersionProxy, proxyV2FamilyTCP4, proxyV2MaxPayloadLen+1, nil),
+		"v2 version":      v2(0x11, proxyV2FamilyTCP4, proxyV2AddrsLenTCP4, make([]byte, proxyV2AddrsLenTCP4)),
+		"v2 short TCP4":   v2(proxyV2VersionProxy, proxyV2FamilyTCP4, 4, make([]byte, 4)),
+		"v2 short TCP6":   v2(proxyV2VersionProxy, proxyV2FamilyTCP6, proxyV2AddrsLenTCP4, make([]byte, proxyV2AddrsLenTCP4)),
+		"v2 short header": proxyV2Signature[:10],
+	} {
+		if src, dst, err := readProxyHeader(bytes.NewReader(header)); err == nil {
+			t.Errorf("%v: read %v and %v", name, src, dst)
+		}
+	}
+}
+
+func TestReadProxyHeaderWithoutAddresses(t *testing.T) {
+	local := append(append([]byte(nil), proxyV2Signature...), proxyV2CommandLocal, proxyV2FamilyUnspec, 0, 0)
+	unspec := append(append([]byte(nil), proxyV2Signature...), proxyV2VersionProxy, proxyV2FamilyUnspec, 0, 3, 1, 2, 3)
+	for name, header := range map[string][]byte{
+		"v1 UNKNOWN": []byte("PROXY UNKNOWN 192.0.2.1 10.0.0.2 1234 443\r\n"),
+		"v2 LOCAL":   local,
+		"v2 UNSPEC":  unspec,
+	} {
+		r := bytes.NewReader(append(header, "rest"...))
+		src, dst, err := readProxyHeader(r)
+		if err != nil || src != nil || dst != nil {
+			t.Errorf("%v: read %v and %v, %v, want no addresses", name, src, dst, err)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "rest" {
+			t.Errorf("%v: %q left after the header", name, rest)
+		}
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	for _, tt := range []struct {
+		trusted string
+		remote  string
+		rest    string
+	}{
+		{"127.0.0.1", "192.0.2.1", "hello"},
+		{"10.0.0.0/8", "127.0.0.1", "PROXY TCP4 192.0.2.1 10.0.0.2 1234 443\r\nhello"},
+	} {
+		trusted, err := parseCIDRs([]string{tt.trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl := &proxyListener{Listener: l, trusted: trusted}
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("PROXY TCP4 192.0.2.1 10.0.0.2 1234 443\r\nhello"))
+		c.(*net.TCPConn).CloseWrite()
+
+		conn, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := addrIP(conn.RemoteAddr()); ip.String() != tt.remote {
+			t.Errorf("trusting %v: remote address is %v, want %v", tt.trusted, ip, tt.remote)
+		}
+		if rest, _ := io.ReadAll(conn); string(rest) != tt.rest {
+			t.Errorf("trusting %v: read %q, want %q", tt.trusted, rest, tt.rest)
+		}
+		conn.Close()
+		c.Close()
+		l.Close()
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs([]string{"192.0.2.1", "2001:db8::1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"192.0.2.1/32", "2001:db8::1/128", "10.0.0.0/8"} {
+		if networks[i].String() != want {
+			t.Errorf("network %v is %v, want %v", i, networks[i], want)
+		}
+	}
+
+	for _, invalid := range []string{"example.com", "10.0.0.0/33", ""} {
+		if _, err := parseCIDRs([]string{invalid}); err == nil {
+			t.Errorf("%q was parsed", invalid)
+		}
+	}
+}
+
+func TestIsTrusted(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"10.0.0.0/8", "::1"})
+	for addr, want := range map[net.Addr]bool{
+		tcpAddr("10.1.2.3", 1):                     true,
+		tcpAddr("::1", 1):                          true,
+		tcpAddr("192.0.2.1", 1):                    false,
+		&net.UnixAddr{Name: "/tmp/x", Net: "unix"}: false,
+	} {
+		if got := isTrusted(trusted, addr); got != want {
+			t.Errorf("%v trusted is %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// QUIC version 1 Initial packets are encrypted with keys derived from the
+// client's destination connection ID, so anyone on the path can read the
+// ClientHello they carry (RFC 9001, section 5.2).
+
+const (
+	quicVersion1       = 0x00000001
+	quicMinInitialSize = 1200 // clients pad datagrams with Initial packets to at least this
+	quicMaxCIDLen      = 20
+	quicSampleLen      = 16
+
+	quicFramePadding         = 0x00
+	quicFramePing            = 0x01
+	quicFrameACK             = 0x02
+	quicFrameACKECN          = 0x03
+	quicFrameCrypto          = 0x06
+	quicFrameConnectionClose = 0x1c
+)
+
+var quicV1InitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+var (
+	errQUICNotInitial = errors.New("not a QUIC v1 Initial packet")
+	errQUICMalformed  = errors.New("malformed QUIC packet")
+)
+
+// quicLongHeader holds the unprotected fields of a long header packet.
+type quicLongHeader struct {
+	version uint32
+	typ     uint8
+	dcid    []byte
+	scid    []byte
+}
+
+// isQUICLongHeader reports whether a datagram starts with a long header
+// packet.
+func isQUICLongHeader(b []byte) bool {
+	return len(b) > 0 && b[0]&0x80 != 0
+}
+
+// readQUICVarint decodes a variable-length integer, returning the number of
+// bytes it took or 0 if b is too short.
+func readQUICVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n
+}
+
+// parseQUICLongHeader reads the version and connection IDs of a long header
+// packet and returns the offset of the version specific fields.
+func parseQUICLongHeader(b []byte) (h quicLongHeader, off int, err error) {
+	if len(b) < 7 || !isQUICLongHeader(b) {
+		return h, 0, errQUICMalformed
+	}
+	h.typ = (b[0] >> 4) & 0x03
+	h.version = binary.BigEndian.Uint32(b[1:5])
+
+	off = 5
+	for _, cid := range []*[]byte{&h.dcid, &h.scid} {
+		if off >= len(b) {
+			return h, 0, errQUICMalformed
+		}
+		n := int(b[off])
+		off++
+		if n > quicMaxCIDLen || off+n > len(b) {
+			return h, 0, errQUICMalformed
+		}
+		*cid = b[off : off+n]
+		off += n
+	}
+	return h, off, nil
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label from TLS 1.3 with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = append(info, byte(length>>8), byte(length), byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0)
+
+	out := make([]byte, length)
+	io.ReadFull(hkdf.Expand(sha256.New, secret, info), out)
+	return out
+}
+
+// quicClientInitialKeys derives the packet and header protection keys of
+// the client's Initial packets.
+func quicClientInitialKeys(dcid []byte) (aead cipher.AEAD, iv []byte, hp cipher.Block, err error) {
+	initial := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	secret := hkdfExpandLabel(initial, "client in", sha256.Size)
+
+	block, err := aes.NewCipher(hkdfExpandLabel(secret, "quic key", 16))
+	if err != nil {
+		return
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return
+	}
+	iv = hkdfExpandLabel(secret, "quic iv", 12)
+	hp, err = aes.NewCipher(hkdfExpandLabel(secret, "quic hp", 16))
+	return
+}
+
+// openQUICInitial removes the protection from the first packet of a
+// datagram, which must be a client's v1 Initial packet, and returns its
+// header and decrypted frames.
+func openQUICInitial(b []byte) (quicLongHeader, []byte, error) {
+	h, off, err := parseQUICLongHeader(b)
+	if err != nil {
+		return h, nil, err
+	}
+	if h.version != quicVersion1 || h.typ != 0 {
+		return h, nil, errQUICNotInitial
+	}
+
+	tokenLen, n := readQUICVarint(b[off:])
+	if n == 0 || uint64(len(b)-off-n) < tokenLen {
+		return h, nil, errQUICMalformed
+	}
+	off += n + int(tokenLen)
+
+	length, n := readQUICVarint(b[off:])
+	if n == 0 {
+		return h, nil, errQUICMalformed
+	}
+	pnOffset := off + n
+	if uint64(len(b)-pnOffset) < length || pnOffset+4+quicSampleLen > len(b) {
+		return h, nil, errQUICMalformed
+	}
+	end := pnOffset + int(length)
+
+	aead, iv, hp, err := quicClientInitialKeys(h.dcid)
+	if err != nil {
+		return h, nil, err
+	}
+
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, b[pnOffset+4:pnOffset+4+quicSampleLen])
+
+	first := b[0] ^ mask[0]&0x0f
+	pnLen := int(first&0x03) + 1
+	if pnOffset+pnLen > end {
+		return h, nil, errQUICMalformed
+	}
+
+	header := make([]byte, pnOffset+pnLen)
+	copy(header, b)
+	header[0] = first
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(header[pnOffset+i])
+	}
+
+	nonce := make([]byte, len(iv))
+	copy(nonce, iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+
+	frames, err := aead.Open(nil, nonce, b[pnOffset+pnLen:end], header)
+	if err != nil {
+		return h, nil, fmt.Errorf("failed to decrypt QUIC Initial packet: %v", err)
+	}
+	return h, frames, nil
+}
+
+// cryptoChunk is the data of one CRYPTO frame.
+type cryptoChunk struct {
+	offset uint64
+	data   []byte
+}
+
+// quicCryptoFrames returns the CRYPTO frames among the frames of an Initial
+// packet, skipping the others allowed there.
+func quicCryptoFrames(b []byte) ([]cryptoChunk, error) {
+	var chunks []cryptoChunk
+
+	// varints reads n variable-length integers, returning the last
+	varints := func(n int) (v uint64, ok bool) {
+		for i := 0; i < n; i++ {
+			var size int
+			if v, size = readQUICVarint(b); size == 0 {
+				return 0, false
+			}
+			b = b[size:]
+		}
+		return v, true
+	}
+
+	for len(b) > 0 {
+		typ := b[0]
+		b = b[1:]
+		switch typ {
+		case quicFramePadding, quicFramePing:
+		case quicFrameACK, quicFrameACKECN:
+			// largest acknowledged, delay, range count, first range
+			if _, ok := varints(2); !ok {
+				return nil, errQUICMalformed
+			}
+			ranges, ok := varints(1)
+			if !ok || ranges > uint64(len(b)) {
+				return nil, errQUICMalformed
+			}
+			fields := 1 + 2*int(ranges)
+			if typ == quicFrameACKECN {
+				fields += 3
+			}
+			if _, ok := varints(fields); !ok {
+				return nil, errQUICMalformed
+			}
+		case quicFrameCrypto:
+			offset, ok := varints(1)
+			if !ok {
+				return nil, errQUICMalformed
+			}
+			length, ok := varints(1)
+			if !ok || length > uint64(len(b)) {
+				return nil, errQUICMalformed
+			}
+			chunks = append(chunks, cryptoChunk{offset: offset, data: b[:length]})
+			b = b[length:]
+		case quicFrameConnectionClose:
+			// error code, frame type, reason length
+			reason, ok := varints(3)
+			if !ok || reason > uint64(len(b)) {
+				return nil, errQUICMalformed
+			}
+			b = b[reason:]
+		default:
+			return nil, fmt.Errorf("unexpected frame type %#x in QUIC Initial packet", typ)
+		}
+	}
+	return chunks, nil
+}
+
+// cryptoStream reassembles the client's Initial CRYPTO stream, which may
+// arrive out of order and spread over several packets, until it holds the
+// whole ClientHello.
+type cryptoStream struct {
+	data    []byte
+	pending []cryptoChunk
+}
+
+func (s *cryptoStream) add(chunk cryptoChunk) error {
+	if chunk.offset+uint64(len(chunk.data)) > maxHandshake+4 {
+		return alertRecordOverflow
+	}
+	s.pending = append(s.pending, cryptoChunk{offset: chunk.offset, data: append([]byte(nil), chunk.data...)})
+
+	for progress := true; progress; {
+		progress = false
+		rest := s.pending[:0]
+		for _, c := range s.pending {
+			end := c.offset + uint64(len(c.data))
+			switch {
+			case end <= uint64(len(s.data)):
+			case c.offset <= uint64(len(s.data)):
+				s.data = append(s.data, c.data[uint64(len(s.data))-c.offset:]...)
+				progress = true
+			default:
+				rest = append(rest, c)
+			}
+		}
+		s.pending = rest
+	}
+	return nil
+}
+
+// clientHello returns the ClientHello once all of it has arrived.
+func (s *cryptoStream) clientHello() (*ClientHelloMessage, bool, error) {
+	if len(s.data) < 4 {
+		return nil, false, nil
+	}
+	n := int(s.data[1])<<16 | int(s.data[2])<<8 | int(s.data[3])
+	if n > maxHandshake {
+		return nil, false, alertInternalError
+	}
+	if len(s.data) < 4+n {
+		return nil, false, nil
+	}
+	if s.data[0] != typeClientHello {
+		return nil, false, alertUnexpectedMessage
+	}
+
+	msg := new(ClientHelloMessage)
+	if !msg.unmarshal(s.data[:4+n]) {
+		return nil, false, alertUnexpectedMessage
+	}
+	return msg, true, nil
+}
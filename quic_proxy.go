@@ -0,0 +1,542 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultQUICIdleTimeout = 30000 // milliseconds
+
+	maxQUICDatagram = 65535
+	maxQUICQueued   = 16   // datagrams held per flow until its ClientHello is complete
+	maxQUICPending  = 4096 // flows waiting for their ClientHello
+)
+
+// quicListener routes QUIC flows arriving on a UDP socket by the server
+// name in their Initial packets. Each flow gets its own socket towards the
+// backend so replies can be told apart. Flows are found by client address,
+// or after the client moved, by a connection ID seen earlier: the client's
+// first destination ID or an ID the backend chose for itself.
+//
+// Terminating frontends cannot serve QUIC, and neither bandwidth limits nor
+// tracing apply to it. Flows do not survive an upgrade.
+type quicListener struct {
+	s         *Server
+	name      string
+	conn      net.PacketConn
+	frontends map[string]bool
+	routes    routeTable
+	targets   map[*Listener]*Frontend
+	idle      time.Duration
+
+	sync.Mutex
+	byAddr  map[string]*quicFlow
+	byCID   map[string]*quicFlow
+	cidLens map[int]bool
+	pending int
+}
+
+func (q *quicListener) serves(front *Frontend) bool {
+	return q.frontends[front.name]
+}
+
+// serveQUIC opens the UDP socket for conf and starts routing its flows.
+func (s *Server) serveQUIC(conf Listen) error {
+	pc, err := s.listenPacket(conf.Name, conf.Protocol, conf.Address)
+	if err != nil {
+		return err
+	}
+	s.track(pc)
+	s.Info("serving QUIC", "listener", conf.Name, "addr", pc.LocalAddr())
+
+	q := &quicListener{
+		s:         s,
+		name:      conf.Name,
+		conn:      pc,
+		frontends: make(map[string]bool),
+		targets:   make(map[*Listener]*Frontend),
+		idle:      time.Duration(defaultQUICIdleTimeout) * time.Millisecond,
+		byAddr:    make(map[string]*quicFlow),
+		byCID:     make(map[string]*quicFlow),
+		cidLens:   make(map[int]bool),
+	}
+	for _, name := range conf.Frontends {
+		l := &Listener{name: routeName(name)}
+		if err := q.routes.add(l.name, l); err != nil {
+			return err
+		}
+		q.targets[l] = s.Frontends[name]
+		q.frontends[name] = true
+	}
+
+	s.wait.Add(1)
+	go q.serve()
+	return nil
+}
+
+func (q *quicListener) serve() {
+	defer q.s.wait.Done()
+
+	buf := make([]byte, maxQUICDatagram)
+	for {
+		n, addr, err := q.conn.ReadFrom(buf)
+		if err != nil {
+			if isClosed(err) {
+				return
+			}
+			q.s.Error("failed to read datagram", "listener", q.name, "err", err)
+			continue
+		}
+		q.handle(addr, buf[:n])
+	}
+}
+
+func (q *quicListener) handle(addr net.Addr, b []byte) {
+	q.Lock()
+	flow := q.lookup(addr, b)
+	q.Unlock()
+
+	if flow == nil {
+		if flow = q.newFlow(addr, b); flow == nil {
+			return
+		}
+	}
+	flow.receive(b)
+}
+
+// lookup finds the flow a datagram belongs to, following clients that moved
+// to a new address. q must be locked.
+func (q *quicListener) lookup(addr net.Addr, b []byte) *quicFlow {
+	if flow, ok := q.byAddr[addr.String()]; ok {
+		return flow
+	}
+
+	var flow *quicFlow
+	if isQUICLongHeader(b) {
+		if h, _, err := parseQUICLongHeader(b); err == nil {
+			flow = q.byCID[string(h.dcid)]
+		}
+	} else {
+		for n := range q.cidLens {
+			if len(b) > n {
+				if flow = q.byCID[string(b[1:1+n])]; flow != nil {
+					break
+				}
+			}
+		}
+	}
+
+	if flow != nil && !flow.closed {
+		delete(q.byAddr, flow.client.String())
+		flow.client = addr
+		q.byAddr[addr.String()] = flow
+		return flow
+	}
+	return nil
+}
+
+// newFlow starts a flow for a datagram from an unknown client, which must
+// carry a QUIC v1 Initial packet. Anything else is dropped.
+func (q *quicListener) newFlow(addr net.Addr, b []byte) *quicFlow {
+	if len(b) < quicMinInitialSize || !isQUICLongHeader(b) {
+		return nil
+	}
+	h, _, err := parseQUICLongHeader(b)
+	if err != nil || h.version != quicVersion1 || h.typ != 0 {
+		return nil
+	}
+
+	s := q.s
+	if err := s.acl.check(addr); err != nil {
+		s.metrics.muxErrors.WithLabelValues(muxErrorType(Forbidden{err})).Inc()
+		s.Debug("dropped QUIC flow", "listener", q.name, "remote", addr, "err", err)
+		return nil
+	}
+	if err := s.sourceRate.check(addr); err != nil {
+		s.metrics.muxErrors.WithLabelValues(muxErrorType(err)).Inc()
+		s.Debug("dropped QUIC flow", "listener", q.name, "remote", addr, "err", err)
+		return nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	if q.pending >= maxQUICPending {
+		s.Debug("dropped QUIC flow, too many pending", "listener", q.name, "remote", addr)
+		return nil
+	}
+	q.pending++
+
+	flow := &quicFlow{
+		q:      q,
+		client: addr,
+		keys:   []string{string(h.dcid)},
+		entry: &accessLogEntry{
+			Time:   time.Now(),
+			ID:     atomic.AddUint64(&s.nextID, 1),
+			Client: addr,
+		},
+	}
+	q.byAddr[addr.String()] = flow
+	q.byCID[string(h.dcid)] = flow
+	flow.timer = time.AfterFunc(time.Duration(s.Handshake.Timeout)*time.Millisecond, func() {
+		flow.close("handshake timeout")
+	})
+	s.metrics.accepted.WithLabelValues(q.name).Inc()
+	return flow
+}
+
+type quicFlow struct {
+	q       *quicListener
+	crypto  cryptoStream
+	routing bool // the ClientHello is complete, only used by the read loop
+	timer   *time.Timer
+	entry   *accessLogEntry
+	active  int64 // unix nanoseconds of the last datagram either way
+
+	// guarded by q's lock
+	client   net.Addr
+	keys     []string
+	queued   [][]byte // datagrams waiting for upstream
+	upstream net.Conn
+	closed   bool
+	reason   string
+
+	front   *Frontend
+	backend Backend
+	bytesIn prometheus.Counter // set before the flow's queued datagrams are forwarded
+}
+
+// Close ends the flow; it lets sessions force-close flows.
+func (f *quicFlow) Close() error {
+	f.close("closed")
+	return nil
+}
+
+// close forgets the flow and closes its backend socket, if it has one. The
+// first reason given is the one logged.
+func (f *quicFlow) close(reason string) {
+	q := f.q
+	q.Lock()
+	if f.closed {
+		q.Unlock()
+		return
+	}
+	f.closed = true
+	f.reason = reason
+	if q.byAddr[f.client.String()] == f {
+		delete(q.byAddr, f.client.String())
+	}
+	for _, key := range f.keys {
+		if q.byCID[key] == f {
+			delete(q.byCID, key)
+		}
+	}
+	upstream := f.upstream
+	if upstream == nil {
+		q.pending--
+	}
+	q.Unlock()
+
+	f.timer.Stop()
+	if upstream != nil {
+		upstream.Close()
+	}
+}
+
+func (f *quicFlow) touch() {
+	atomic.StoreInt64(&f.active, time.Now().UnixNano())
+}
+
+// receive handles a datagram from the client. Until the backend socket is
+// ready, datagrams are held back, and until the ClientHello is complete their
+// Initial packets are decrypted.
+func (f *quicFlow) receive(b []byte) {
+	f.q.Lock()
+	upstream, closed, full := f.upstream, f.closed, len(f.queued) >= maxQUICQueued
+	if upstream == nil && !closed && !full {
+		f.queued = append(f.queued, append([]byte(nil), b...))
+	}
+	f.q.Unlock()
+
+	if closed {
+		return
+	}
+	if upstream != nil {
+		f.forward(upstream, b)
+		return
+	}
+	if full {
+		f.fail("too many datagrams before the flow was routed", nil)
+		return
+	}
+	if f.routing {
+		return
+	}
+
+	_, frames, err := openQUICInitial(b)
+	if err == errQUICNotInitial {
+		return
+	}
+	if err != nil {
+		f.fail("failed to read QUIC Initial packet", BadRequest{err})
+		return
+	}
+
+	chunks, err := quicCryptoFrames(frames)
+	if err != nil {
+		f.fail("failed to read QUIC Initial packet", BadRequest{err})
+		return
+	}
+	for _, chunk := range chunks {
+		if err := f.crypto.add(chunk); err != nil {
+			f.fail("failed to read ClientHello", BadRequest{err})
+			return
+		}
+	}
+
+	hello, ok, err := f.crypto.clientHello()
+	if err != nil {
+		f.fail("failed to read ClientHello", BadRequest{err})
+		return
+	}
+	if ok {
+		f.routing = true
+		f.route(hello)
+	}
+}
+
+func (f *quicFlow) forward(upstream net.Conn, b []byte) {
+	n, err := upstream.Write(b)
+	if err != nil {
+		f.close("backend error: " + err.Error())
+		return
+	}
+	f.touch()
+	atomic.AddInt64(&f.entry.BytesIn, int64(n))
+	if f.bytesIn != nil {
+		f.bytesIn.Add(float64(n))
+	}
+}
+
+// fail closes a flow that could not be routed, counting err if it is one of
+// the muxer's error types.
+func (f *quicFlow) fail(reason string, err error) {
+	s := f.q.s
+	if err != nil {
+		s.metrics.muxErrors.WithLabelValues(muxErrorType(err)).Inc()
+		s.Warn("failed to route QUIC flow", "listener", f.q.name, "remote", f.entry.Client, "reason", reason, "err", err)
+	} else {
+		s.Warn("failed to route QUIC flow", "listener", f.q.name, "remote", f.entry.Client, "reason", reason)
+	}
+	f.close(reason)
+}
+
+// route picks a frontend and backend for the flow the way the muxer and the
+// fallback chain would for TCP, then dials the backend in the background so
+// that resolving its name does not hold up the read loop.
+func (f *quicFlow) route(hello *ClientHelloMessage) {
+	q, s := f.q, f.q.s
+
+	in := ruleInput{
+		Host:     normalize(hello.ServerName),
+		Source:   addrIP(f.entry.Client),
+		ALPN:     hello.ALPNProtocols,
+		Version:  hello.Version(),
+		JA3:      hello.JA3(),
+		protocol: protoTLS,
+		tls:      true,
+	}
+	f.entry.SNI = hello.ServerName
+	f.entry.ALPN = strings.Join(hello.ALPNProtocols, ",")
+	f.entry.JA3 = in.JA3
+
+	var front *Frontend
+	captures := []string{in.Host}
+	served := func(name string) bool { return q.frontends[name] }
+	if r := s.rules.match(in, served); r != nil {
+		front = s.Frontends[r.frontend]
+	} else if l, c := q.routes.match(in.Host); l != nil {
+		front, captures = q.targets[l], c
+	} else if fallback := s.fallbacks.frontend(in.Host); fallback != nil && q.serves(fallback) {
+		front = fallback
+	}
+	if front == nil {
+		f.fail("host not found", NotFound{fmt.Errorf("host not found: %v", in.Host)})
+		return
+	}
+	f.entry.Frontend = front.name
+	logger := front.logger.With("conn", f.entry.ID, "listener", q.name)
+
+	if err := front.acl.check(f.entry.Client); err != nil {
+		f.fail("forbidden", Forbidden{err})
+		return
+	}
+	if !front.rate.allow(time.Now()) {
+		f.fail("connection rate limit exceeded for frontend", nil)
+		return
+	}
+	if !front.conns.acquire() {
+		f.fail("too many connections to frontend", nil)
+		return
+	}
+	backend, ok := s.nextBackend(front)
+	if !ok {
+		front.conns.release()
+		f.fail("too many connections to every backend", nil)
+		return
+	}
+
+	logger.Debug("routed QUIC flow", "remote", f.entry.Client, "sni", in.Host, "backend", backend.Address)
+	go f.dial(front, backend, captures, logger)
+}
+
+// dial opens the flow's socket towards backend, forwards the datagrams
+// queued so far in order and starts relaying.
+func (f *quicFlow) dial(front *Frontend, backend Backend, captures []string, logger *slog.Logger) {
+	q, s := f.q, f.q.s
+
+	address, err := expandAddress(backend.Address, captures)
+	var upstream net.Conn
+	if err == nil {
+		upstream, err = net.Dial("udp", address)
+	}
+	if err != nil {
+		backend.conns.release()
+		front.conns.release()
+		logger.Error("failed to dial backend", "backend", address, "err", err)
+		f.close("backend error: " + err.Error())
+		return
+	}
+	f.entry.Backend = address
+	f.front, f.backend = front, backend
+	f.bytesIn = s.metrics.bytes.WithLabelValues(front.name, backend.Address, "in")
+
+	// the read loop keeps queueing until upstream is set, which only
+	// happens once the queue has been drained
+	for {
+		q.Lock()
+		if f.closed {
+			q.Unlock()
+			upstream.Close()
+			backend.conns.release()
+			front.conns.release()
+			return
+		}
+		queued := f.queued
+		f.queued = nil
+		if len(queued) == 0 {
+			f.upstream = upstream
+			q.pending--
+			q.Unlock()
+			break
+		}
+		q.Unlock()
+
+		for _, b := range queued {
+			f.forward(upstream, b)
+		}
+	}
+	f.timer.Stop()
+
+	sess := &session{client: f, upstream: upstream, front: front, backend: backend}
+	s.sessions.add(sess)
+	go f.relay(sess, logger)
+}
+
+// relay copies the backend's datagrams back to the client until the flow is
+// idle for too long or closed, then finishes it.
+func (f *quicFlow) relay(sess *session, logger *slog.Logger) {
+	q, s := f.q, f.q.s
+	front, backend := f.front, f.backend
+
+	frontActive := s.metrics.frontendActive.WithLabelValues(front.name)
+	backActive := s.metrics.backendActive.WithLabelValues(front.name, backend.Address)
+	frontActive.Inc()
+	backActive.Inc()
+	bytesOut := s.metrics.bytes.WithLabelValues(front.name, backend.Address, "out")
+
+	idle := q.idle
+	if front.IdleTimeout > 0 {
+		idle = time.Duration(front.IdleTimeout) * time.Millisecond
+	}
+	if front.SessionTimeout > 0 {
+		timer := time.AfterFunc(time.Duration(front.SessionTimeout)*time.Millisecond, func() {
+			f.close("session timeout")
+		})
+		defer timer.Stop()
+	}
+
+	f.touch()
+	buf := make([]byte, maxQUICDatagram)
+	for {
+		f.upstream.SetReadDeadline(time.Now().Add(idle))
+		n, err := f.upstream.Read(buf)
+		if err != nil {
+			if isTimeout(err) {
+				if time.Since(time.Unix(0, atomic.LoadInt64(&f.active))) < idle {
+					continue
+				}
+				f.close("idle timeout")
+			} else {
+				f.close("backend closed")
+			}
+			break
+		}
+		f.learnCID(buf[:n])
+		f.touch()
+
+		q.Lock()
+		client := f.client
+		q.Unlock()
+		if _, err := q.conn.WriteTo(buf[:n], client); err != nil {
+			logger.Debug("failed to write datagram to client", "remote", client, "err", err)
+			continue
+		}
+		atomic.AddInt64(&f.entry.BytesOut, int64(n))
+		bytesOut.Add(float64(n))
+	}
+
+	s.sessions.remove(sess)
+	backend.conns.release()
+	front.conns.release()
+	frontActive.Dec()
+	backActive.Dec()
+
+	q.Lock()
+	f.entry.CloseReason = f.reason
+	q.Unlock()
+	f.entry.Duration = time.Since(f.entry.Time)
+	if err := s.accessLog.log(f.entry); err != nil {
+		logger.Error("failed to write access log", "err", err)
+	}
+}
+
+// learnCID remembers the connection ID a backend chose for itself, so that
+// the flow can still be found once the client moves to a new address.
+func (f *quicFlow) learnCID(b []byte) {
+	if !isQUICLongHeader(b) {
+		return
+	}
+	h, _, err := parseQUICLongHeader(b)
+	if err != nil || len(h.scid) == 0 {
+		return
+	}
+
+	q := f.q
+	q.Lock()
+	defer q.Unlock()
+	if f.closed || q.byCID[string(h.scid)] == f {
+		return
+	}
+	q.byCID[string(h.scid)] = f
+	q.cidLens[len(h.scid)] = true
+	f.keys = append(f.keys, string(h.scid))
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// quicClientHello returns the ClientHello crypto/tls sends at the start of a
+// QUIC handshake with sni.
+func quicClientHello(t *testing.T, sni string) []byte {
+	t.Helper()
+	qc := tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{ServerName: sni, NextProtos: []string{"h3"}, MinVersion: tls.VersionTLS13}})
+	qc.SetTransportParameters(nil)
+	if err := qc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer qc.Close()
+	for {
+		ev := qc.NextEvent()
+		switch ev.Kind {
+		case tls.QUICNoEvent:
+			t.Fatal("no ClientHello from the QUIC client")
+		case tls.QUICWriteData:
+			return append([]byte(nil), ev.Data...)
+		}
+	}
+}
+
+// appendQUICVarint appends v in the four byte variable-length encoding.
+func appendQUICVarint(b []byte, v uint64) []byte {
+	return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// sealQUICInitial builds a protected client Initial packet carrying data in
+// a CRYPTO frame at offset, followed by pad bytes of PADDING.
+func sealQUICInitial(t *testing.T, dcid, scid []byte, pn uint32, offset int, data []byte, pad int) []byte {
+	t.Helper()
+	aead, iv, hp, err := quicClientInitialKeys(dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := appendQUICVarint([]byte{0x06}, uint64(offset))
+	payload = appendQUICVarint(payload, uint64(len(data)))
+	payload = append(payload, data...)
+	payload = append(payload, make([]byte, pad)...)
+
+	header := []byte{0xc3, 0, 0, 0, 1, byte(len(dcid))}
+	header = append(header, dcid...)
+	header = append(header, byte(len(scid)))
+	header = append(header, scid...)
+	header = append(header, 0) // no token
+	header = appendQUICVarint(header, uint64(4+len(payload)+aead.Overhead()))
+	pnOffset := len(header)
+	header = append(header, byte(pn>>24), byte(pn>>16), byte(pn>>8), byte(pn))
+
+	nonce := append([]byte(nil), iv...)
+	for i := 0; i < 4; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	packet := aead.Seal(append([]byte(nil), header...), nonce, payload, header)
+
+	mask := make([]byte, aes.BlockSize)
+	hp.Encrypt(mask, packet[pnOffset+4:pnOffset+4+quicSampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// RFC 9001, appendix A.1
+func TestQUICInitialKeys(t *testing.T) {
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	_, iv, _, err := quicClientInitialKeys(dcid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := hkdfExpandLabel(hkdf.Extract(sha256.New, dcid, quicV1InitialSalt), "client in", sha256.Size)
+
+	for _, tt := range []struct {
+		name, got, want string
+	}{
+		{"client secret", hex.EncodeToString(secret), "c00cf151ca5be075ed0ebfb5c80323c42d6b7db67881289af4008f1f6c357aea"},
+		{"key", hex.EncodeToString(hkdfExpandLabel(secret, "quic key", 16)), "1f369613dd76d5467730efcbe3b1a22d"},
+		{"iv", hex.EncodeToString(iv), "fa044b2f42a3fd3b46fb255c"},
+		{"hp", hex.EncodeToString(hkdfExpandLabel(secret, "quic hp", 16)), "9f50449e04a0e810283a1e9933adedd2"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%v is %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestQUICInitialClientHello(t *testing.T) {
+	hello := quicClientHello(t, "Quic.Example.com")
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	half := len(hello) / 2
+
+	// the second half arrives first
+	var stream cryptoStream
+	for i, packet := range [][]byte{
+		sealQUICInitial(t, dcid, []byte{9}, 1, half, hello[half:], 1200),
+		sealQUICInitial(t, dcid, []byte{9}, 0, 0, hello[:half], 1200),
+	} {
+		h, frames, err := openQUICInitial(packet)
+		if err != nil {
+			t.Fatalf("packet %v: %v", i, err)
+		}
+		if !bytes.Equal(h.dcid, dcid) || !bytes.Equal(h.scid, []byte{9}) {
+			t.Errorf("packet %v: connection IDs %x and %x", i, h.dcid, h.scid)
+		}
+		chunks, err := quicCryptoFrames(frames)
+		if err != nil {
+			t.Fatalf("packet %v: %v", i, err)
+		}
+		for _, c := range chunks {
+			if err := stream.add(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		msg, ok, err := stream.clientHello()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (i == 1) {
+			t.Fatalf("packet %v: ClientHello complete is %v", i, ok)
+		}
+		if ok {
+			if msg.ServerName != "Quic.Example.com" {
+				t.Errorf("server name is %q", msg.ServerName)
+			}
+			if len(msg.ALPNProtocols) != 1 || msg.ALPNProtocols[0] != "h3" {
+				t.Errorf("ALPN is %v", msg.ALPNProtocols)
+			}
+			if msg.Version() != tls.VersionTLS13 {
+				t.Errorf("version is %#04x", msg.Version())
+			}
+		}
+	}
+}
+
+func TestQUICInitialInvalid(t *testing.T) {
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	packet := sealQUICInitial(t, dcid, nil, 0, 0, quicClientHello(t, "example.com"), 1200)
+
+	tampered := append([]byte(nil), packet...)
+	tampered[len(tampered)-1] ^= 1
+	version2 := append([]byte(nil), packet...)
+	copy(version2[1:5], []byte{0x6b, 0x33, 0x43, 0xcf})
+
+	for name, b := range map[string][]byte{
+		"tampered":  tampered,
+		"version 2": version2,
+		"truncated": packet[:40],
+		"short":     {0x40, 1, 2, 3},
+	} {
+		if _, _, err := openQUICInitial(b); err == nil {
+			t.Errorf("%v packet was opened", name)
+		}
+	}
+}
+
+// quicAddr returns the address of the server's first UDP listener.
+func quicAddr(t *testing.T, s *testServer) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, l := range s.listeners {
+		if pc, ok := l.(net.PacketConn); ok {
+			return pc.LocalAddr().String()
+		}
+	}
+	t.Fatal("no UDP listener")
+	return ""
+}
+
+func TestQUICProxy(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, maxQUICDatagram)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	s := startServer(t, `
+listeners:
+  - name: quic
+    protocol: udp
+    addr: 127.0.0.1:0
+frontends:
+  quic.example.com:
+    idle_timeout: 500
+    backends:
+      - addr: localhost:%v
+`, nil, backend.LocalAddr().(*net.UDPAddr).Port)
+	addr := quicAddr(t, s)
+
+	hello := quicClientHello(t, "quic.example.com")
+	dcid := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	half := len(hello) / 2
+	packets := [][]byte{
+		sealQUICInitial(t, dcid, []byte{9}, 0, 0, hello[:half], 1200),
+		sealQUICInitial(t, dcid, []byte{9}, 1, half, hello[half:], 1200),
+		[]byte("sent while the backend is being dialled"),
+	}
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the flow is held back until the whole ClientHello is in and the
+	// backend's name is resolved, then relayed in order
+	for _, packet := range packets {
+		c.Write(packet)
+	}
+	buf := make([]byte, maxQUICDatagram)
+	for i, packet := range packets {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("packet %v: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], packet) {
+			t.Errorf("packet %v was not relayed as sent", i)
+		}
+	}
+
+	// an unknown server name gets no flow
+	other, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Write(sealQUICInitial(t, []byte{7, 7, 7, 7}, nil, 0, 0, quicClientHello(t, "unknown.example.com"), 1200))
+	other.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, err := other.Read(buf); err == nil {
+		t.Error("unknown server name was relayed")
+	}
+}
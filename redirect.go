@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRedirectAddress = ":80"
+	defaultRedirectCode    = http.StatusTemporaryRedirect
+
+	redirectReadTimeout = 10 * time.Second
+	redirectIdleTimeout = 60 * time.Second
+
+	maxHostLen = 253
+)
+
+// validHostName accepts lower cased DNS names, the only hosts besides IP
+// addresses that redirects are sent to.
+var validHostName = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*\.?$`)
+
+// Redirect configures the plain HTTP listener that sends clients to HTTPS.
+// Only hosts routed to a frontend are redirected, unless AnyHost is set, and
+// frontends can opt out with no_redirect. AnyHost redirects any well-formed
+// host name or IP address the client sends, so a shared cache in front of the
+// listener could be made to store redirects to hosts this server does not
+// serve. Port is the HTTPS port in the redirect target, left out when it is
+// 443. On shutdown, requests in flight get up to the drain timeout to finish.
+//
+// HSTS is the max-age in seconds of a Strict-Transport-Security header added
+// to redirects, 0 sends none. RFC 6797, section 7.2, forbids the header over
+// plain HTTP and browsers ignore it there, so it is only meant for setups
+// where something downstream, such as a CDN terminating HTTPS, serves these
+// redirects to clients over HTTPS. Otherwise leave it to the backends.
+//
+// For compatibility, "redirect: true" enables it with the defaults.
+type Redirect struct {
+	Enabled        bool   `yaml:"enabled"`
+	Address        string `yaml:"addr"`
+	Code           int    `yaml:"code"`
+	Port           int    `yaml:"port"`
+	AnyHost        bool   `yaml:"any_host"`
+	HSTS           int    `yaml:"hsts"`
+	HSTSSubdomains bool   `yaml:"hsts_include_subdomains"`
+}
+
+// UnmarshalYAML accepts a plain boolean as well as the full settings.
+func (r *Redirect) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&r.Enabled); err == nil {
+		return nil
+	}
+
+	type plain Redirect
+	r.Enabled = true
+	return unmarshal((*plain)(r))
+}
+
+func (r *Redirect) setDefaults() error {
+	if r.Address == "" {
+		r.Address = defaultRedirectAddress
+	}
+
+	if r.Code == 0 {
+		r.Code = defaultRedirectCode
+	}
+	switch r.Code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("redirect code must be 301, 302, 303, 307 or 308")
+	}
+
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("redirect port must be between 1 and 65535")
+	}
+
+	if r.HSTS < 0 {
+		return fmt.Errorf("redirect hsts must not be negative")
+	}
+	return nil
+}
+
+// hstsHeader returns the Strict-Transport-Security value to send, if any.
+func (r *Redirect) hstsHeader() string {
+	if r.HSTS == 0 {
+		return ""
+	}
+	header := "max-age=" + strconv.Itoa(r.HSTS)
+	if r.HSTSSubdomains {
+		header += "; includeSubDomains"
+	}
+	return header
+}
+
+// redirector answers plain HTTP requests with redirects to HTTPS.
+type redirector struct {
+	s       *Server
+	conf    Redirect
+	hsts    string
+	routes  routeTable
+	targets map[*Listener]*Frontend
+}
+
+func newRedirector(s *Server) (*redirector, error) {
+	r := &redirector{
+		s:       s,
+		conf:    s.Configuration.Redirect,
+		hsts:    s.Configuration.Redirect.hstsHeader(),
+		targets: make(map[*Listener]*Frontend),
+	}
+
+	for _, name := range s.frontendOrder {
+		if protocol, _ := splitProtocol(name); protocol != protoTLS {
+			continue
+		}
+		l := &Listener{name: routeName(name)}
+		if err := r.routes.add(l.name, l); err != nil {
+			return nil, err
+		}
+		r.targets[l] = s.Frontends[name]
+	}
+	return r, nil
+}
+
+// frontend returns the frontend a TLS connection to host would most likely
+// reach, or nil. Rules are left out since they depend on the ClientHello.
+func (r *redirector) frontend(host string) *Frontend {
+	if host == "" {
+		return nil
+	}
+	if l, _ := r.routes.match(host); l != nil {
+		return r.targets[l]
+	}
+	return r.s.fallbacks.frontend(host)
+}
+
+func (r *redirector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalize(host)
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	if ip == nil && (len(host) > maxHostLen || !validHostName.MatchString(host)) {
+		r.s.Debug("not redirecting invalid host", "host", host, "remote", req.RemoteAddr)
+		http.Error(w, "invalid host", http.StatusBadRequest)
+		return
+	}
+
+	if !r.conf.AnyHost {
+		front := r.frontend(host)
+		if front == nil || front.NoRedirect {
+			r.s.Debug("not redirecting", "host", host, "remote", req.RemoteAddr)
+			http.NotFound(w, req)
+			return
+		}
+	}
+
+	if ip != nil {
+		host = ip.String()
+	}
+	target := "https://" + host
+	if r.conf.Port != 0 && r.conf.Port != 443 {
+		target = "https://" + net.JoinHostPort(host, strconv.Itoa(r.conf.Port))
+	} else if strings.Contains(host, ":") {
+		target = "https://[" + host + "]"
+	}
+	target += req.URL.RequestURI()
+
+	if r.hsts != "" {
+		w.Header().Set("Strict-Transport-Security", r.hsts)
+	}
+	r.s.Debug("redirecting", "target", target)
+	http.Redirect(w, req, target, r.conf.Code)
+}
+
+// serveRedirect starts the redirect listener. It is shut down gracefully by
+// stopRedirect.
+func (s *Server) serveRedirect() error {
+	handler, err := newRedirector(s)
+	if err != nil {
+		return err
+	}
+
+	l, err := s.listen("redirect", "tcp", s.Configuration.Redirect.Address)
+	if err != nil {
+		return err
+	}
+
+	s.redirect = &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: redirectReadTimeout,
+		IdleTimeout:       redirectIdleTimeout,
+		ErrorLog:          slog.NewLogLogger(s.Handler(), slog.LevelWarn),
+	}
+	s.Info("serving redirects", "addr", l.Addr(), "code", s.Configuration.Redirect.Code)
+	go func() {
+		if err := s.redirect.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.Error("failed to serve redirects", "err", err)
+		}
+	}()
+	return nil
+}
+
+// stopRedirect stops the redirect listener, letting requests in flight finish
+// for up to the drain timeout.
+func (s *Server) stopRedirect() {
+	if s.redirect == nil {
+		return
+	}
+
+	timeout := time.Duration(s.DrainTimeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.redirect.Shutdown(ctx); err != nil {
+		s.Warn("redirects did not finish in time", "err", err)
+		s.redirect.Close()
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestRedirector(t *testing.T, redirect string) *redirector {
+	t.Helper()
+	config, err := parseConfiguration([]byte(`
+port: 127.0.0.1:0
+redirect: `+redirect+`
+frontends:
+  example.com:
+    backends:
+      - addr: 127.0.0.1:1
+  "*.example.org":
+    backends:
+      - addr: 127.0.0.1:1
+  private.example.com:
+    no_redirect: true
+    backends:
+      - addr: 127.0.0.1:1
+`), loadTLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRedirector(&Server{
+		Configuration: config,
+		Logger:        newLogger(io.Discard, logFormatLogfmt, slog.LevelError),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRedirect(t *testing.T) {
+	for _, tt := range []struct {
+		redirect string
+		host     string
+		uri      string
+		code     int
+		location string
+	}{
+		{"true", "Example.com", "/a?b=c", http.StatusTemporaryRedirect, "https://example.com/a?b=c"},
+		{"true", "www.example.org:80", "/", http.StatusTemporaryRedirect, "https://www.example.org/"},
+		{"true", "unknown.example.net", "/", http.StatusNotFound, ""},
+		{"true", "private.example.com", "/", http.StatusNotFound, ""},
+		{"{code: 308, port: 8443}", "example.com", "/", http.StatusPermanentRedirect, "https://example.com:8443/"},
+		{"{any_host: true}", "unknown.example.net", "/", http.StatusTemporaryRedirect, "https://unknown.example.net/"},
+		{"{any_host: true}", "[2001:db8::1]", "/", http.StatusTemporaryRedirect, "https://[2001:db8::1]/"},
+		{"{any_host: true}", "192.0.2.1:80", "/", http.StatusTemporaryRedirect, "https://192.0.2.1/"},
+		{"{any_host: true}", "evil.example.net\\@other", "/", http.StatusBadRequest, ""},
+		{"{any_host: true}", "-bad-.example.net", "/", http.StatusBadRequest, ""},
+		{"{any_host: true}", "", "/", http.StatusBadRequest, ""},
+	} {
+		r := newTestRedirector(t, tt.redirect)
+		req := httptest.NewRequest("GET", "http://placeholder"+tt.uri, nil)
+		req.Host = tt.host
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("%v, host %q: got %v to %q, want %v to %q", tt.redirect, tt.host, w.Code, w.Header().Get("Location"), tt.code, tt.location)
+		}
+	}
+}
+
+func TestRedirectHSTS(t *testing.T) {
+	r := newTestRedirector(t, "{hsts: 600, hsts_include_subdomains: true}")
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if got, want := w.Header().Get("Strict-Transport-Security"), "max-age=600; includeSubDomains"; got != want {
+		t.Errorf("Strict-Transport-Security is %q, want %q", got, want)
+	}
+}
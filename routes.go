@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Frontend names are routing patterns, in the style of nginx server names:
+//
+//	example.com       the name itself
+//	*.example.com     any name below example.com, the star is captured as $1
+//	.example.com      example.com and any name below it, captured as $1
+//	~(.+)\.svc\.local a regular expression matching the whole name
+//
+// A protocol prefix such as http:// or ssh:// makes the frontend take
+// connections of that protocol instead of TLS; see Sniff.
+//
+// Exact names win over wildcards and wildcards over suffixes, longest first
+// in both cases. Regular expressions are tried last, in configuration order.
+// Exact names, wildcards and suffixes are kept in a trie of name labels so a
+// lookup costs one map access per label however many frontends there are.
+
+type routeKind int
+
+const (
+	routeExact routeKind = iota
+	routeWildcard
+	routeSuffix
+	routeRegex
+)
+
+const regexPrefix = "~"
+
+const (
+	protoTLS  = "tls"
+	protoHTTP = "http"
+	protoSSH  = "ssh"
+)
+
+// isRegexRoute reports whether the frontend name is a regular expression,
+// which unlike other names must not be lower cased.
+func isRegexRoute(name string) bool {
+	return strings.HasPrefix(name, regexPrefix)
+}
+
+// splitProtocol separates the protocol prefix from a frontend name. Names
+// without one are TLS.
+func splitProtocol(name string) (protocol, pattern string) {
+	if i := strings.Index(name, "://"); i >= 0 && !isRegexRoute(name) {
+		return strings.ToLower(name[:i]), name[i+3:]
+	}
+	return protoTLS, name
+}
+
+// routeName turns a frontend name into the key the muxer knows it by: lower
+// cased unless it is a regular expression, without a port and without the
+// tls:// prefix.
+func routeName(name string) string {
+	protocol, pattern := splitProtocol(name)
+	if !isRegexRoute(pattern) {
+		if host, _, err := net.SplitHostPort(pattern); err == nil {
+			pattern = host
+		}
+		pattern = normalize(pattern)
+	}
+	if protocol == protoTLS {
+		return pattern
+	}
+	return protocol + "://" + pattern
+}
+
+// parseRoute splits a frontend name into its kind and the domain or
+// expression it applies to.
+func parseRoute(name string) (routeKind, string, *regexp.Regexp, error) {
+	switch {
+	case isRegexRoute(name):
+		re, err := regexp.Compile("^(?:" + name[len(regexPrefix):] + ")$")
+		if err != nil {
+			return 0, "", nil, fmt.Errorf("invalid route '%v': %v", name, err)
+		}
+		return routeRegex, "", re, nil
+	case strings.HasPrefix(name, "*."):
+		return routeWildcard, name[2:], nil, nil
+	case strings.HasPrefix(name, "."):
+		return routeSuffix, name[1:], nil, nil
+	}
+	if strings.Contains(name, "*") {
+		return 0, "", nil, fmt.Errorf("invalid route '%v': only a leading '*.' wildcard is supported", name)
+	}
+	return routeExact, name, nil, nil
+}
+
+type routeNode struct {
+	children map[string]*routeNode
+	exact    *Listener
+	wildcard *Listener
+	suffix   *Listener
+}
+
+type regexRoute struct {
+	pattern string
+	re      *regexp.Regexp
+	l       *Listener
+}
+
+// routeTable maps server names to listeners. It is not safe for concurrent
+// use; the muxer guards it with its lock.
+type routeTable struct {
+	root    routeNode
+	regexes []regexRoute
+}
+
+func (t *routeTable) node(domain string, create bool) *routeNode {
+	n := &t.root
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if n.children == nil {
+				n.children = make(map[string]*routeNode)
+			}
+			child = new(routeNode)
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	return n
+}
+
+func (n *routeNode) slot(kind routeKind) **Listener {
+	switch kind {
+	case routeWildcard:
+		return &n.wildcard
+	case routeSuffix:
+		return &n.suffix
+	}
+	return &n.exact
+}
+
+// add routes names matching pattern to l.
+func (t *routeTable) add(pattern string, l *Listener) error {
+	kind, domain, re, err := parseRoute(pattern)
+	if err != nil {
+		return err
+	}
+	if kind == routeRegex {
+		t.regexes = append(t.regexes, regexRoute{pattern: pattern, re: re, l: l})
+		return nil
+	}
+	*t.node(domain, true).slot(kind) = l
+	return nil
+}
+
+// remove drops the route for pattern. Emptied trie nodes are left in place.
+func (t *routeTable) remove(pattern string) {
+	kind, domain, _, err := parseRoute(pattern)
+	if err != nil {
+		return
+	}
+	if kind == routeRegex {
+		for i, r := range t.regexes {
+			if r.pattern == pattern {
+				t.regexes = append(t.regexes[:i], t.regexes[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+	if n := t.node(domain, false); n != nil {
+		*n.slot(kind) = nil
+	}
+}
+
+// match returns the listener for host along with the captured parts of the
+// name. captures[0] is always the whole name.
+func (t *routeTable) match(host string) (*Listener, []string) {
+	var wildcard, suffix *Listener
+	var wildcardAt, suffixAt int
+
+	labels := strings.Split(host, ".")
+	n := &t.root
+	matched := 0
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := n.children[labels[i]]
+		if !ok {
+			break
+		}
+		n = child
+		matched++
+		if n.wildcard != nil && i > 0 {
+			wildcard, wildcardAt = n.wildcard, i
+		}
+		if n.suffix != nil {
+			suffix, suffixAt = n.suffix, i
+		}
+	}
+
+	if matched == len(labels) && n.exact != nil {
+		return n.exact, []string{host}
+	}
+	if wildcard != nil {
+		return wildcard, []string{host, strings.Join(labels[:wildcardAt], ".")}
+	}
+	if suffix != nil {
+		return suffix, []string{host, strings.Join(labels[:suffixAt], ".")}
+	}
+	for _, r := range t.regexes {
+		if captures := r.re.FindStringSubmatch(host); captures != nil {
+			return r.l, captures
+		}
+	}
+	return nil, nil
+}
+
+// validCapture accepts captured name parts that can only form a host name,
+// so that a crafted server name cannot pick a port or scheme.
+var validCapture = regexp.MustCompile(`^[a-z0-9.-]*$`)
+
+// expandAddress replaces $1 or ${1} style references in addr with the
+// captured parts of the server name. An empty capture, such as the one a
+// suffix route has for its own domain, is an error rather than an address
+// like ".internal:443".
+func expandAddress(addr string, captures []string) (string, error) {
+	if !strings.Contains(addr, "$") {
+		return addr, nil
+	}
+
+	var err error
+	expanded := os.Expand(addr, func(ref string) string {
+		i, convErr := strconv.Atoi(ref)
+		if convErr != nil || i < 0 || i >= len(captures) {
+			err = fmt.Errorf("backend address '%v' refers to missing capture $%v", addr, ref)
+			return ""
+		}
+		if captures[i] == "" {
+			err = fmt.Errorf("backend address '%v' refers to capture $%v, which is empty for '%v'", addr, ref, captures[0])
+			return ""
+		}
+		if !validCapture.MatchString(captures[i]) {
+			err = fmt.Errorf("captured name part %q is not a valid host name", captures[i])
+			return ""
+		}
+		return captures[i]
+	})
+	return expanded, err
+}
+
+// checkAddress reports whether addr only refers to the first n captures,
+// expanding it with placeholders for them.
+func checkAddress(addr string, n int) error {
+	captures := make([]string, n)
+	for i := range captures {
+		captures[i] = "capture"
+	}
+	_, err := expandAddress(addr, captures)
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import "testing"
+
+func TestRouteTableMatch(t *testing.T) {
+	var table routeTable
+	listeners := make(map[string]*Listener)
+	for _, pattern := range []string{
+		"example.com",
+		"www.example.com",
+		"*.example.com",
+		"*.eu.example.com",
+		".example.com",
+		".svc.example.com",
+		"~(.+)\\.svc\\.local",
+		"~(.+)\\.local",
+	} {
+		l := &Listener{name: pattern}
+		if err := table.add(pattern, l); err != nil {
+			t.Fatal(err)
+		}
+		listeners[pattern] = l
+	}
+
+	for _, tt := range []struct {
+		host    string
+		want    string
+		capture string
+	}{
+		{"example.com", "example.com", ""},
+		{"www.example.com", "www.example.com", ""},
+		{"api.example.com", "*.example.com", "api"},
+		{"a.b.example.com", "*.example.com", "a.b"},
+		{"api.eu.example.com", "*.eu.example.com", "api"},
+		{"eu.example.com", "*.example.com", "eu"},
+		{"api.svc.example.com", "*.example.com", "api.svc"},
+		{"db.svc.local", "~(.+)\\.svc\\.local", "db"},
+		{"db.local", "~(.+)\\.local", "db"},
+		{"example.org", "", ""},
+	} {
+		l, captures := table.match(tt.host)
+		if l != listeners[tt.want] {
+			name := "nothing"
+			if l != nil {
+				name = l.name
+			}
+			t.Errorf("%v matched %v, want %q", tt.host, name, tt.want)
+			continue
+		}
+		if l == nil {
+			continue
+		}
+		if captures[0] != tt.host {
+			t.Errorf("%v: $0 is %q", tt.host, captures[0])
+		}
+		if tt.capture != "" && (len(captures) < 2 || captures[1] != tt.capture) {
+			t.Errorf("%v: captures are %q, want $1 %q", tt.host, captures, tt.capture)
+		}
+	}
+}
+
+func TestRouteTableSuffix(t *testing.T) {
+	var table routeTable
+	apex, svc := &Listener{name: ".example.com"}, &Listener{name: ".svc.example.com"}
+	table.add(".example.com", apex)
+	table.add(".svc.example.com", svc)
+
+	for host, want := range map[string]*Listener{
+		"example.com":          apex,
+		"www.example.com":      apex,
+		"svc.example.com":      svc,
+		"db.svc.example.com":   svc,
+		"a.db.svc.example.com": svc,
+	} {
+		if l, _ := table.match(host); l != want {
+			t.Errorf("%v did not match the longest suffix", host)
+		}
+	}
+
+	table.remove(".svc.example.com")
+	if l, captures := table.match("db.svc.example.com"); l != apex || captures[1] != "db.svc" {
+		t.Errorf("after removing .svc.example.com, matched %v with %q", l, captures)
+	}
+}
+
+func TestParseRouteInvalid(t *testing.T) {
+	for _, pattern := range []string{"www.*.example.com", "~(unclosed"} {
+		var table routeTable
+		if err := table.add(pattern, &Listener{}); err == nil {
+			t.Errorf("%q was accepted", pattern)
+		}
+	}
+}
+
+func TestExpandAddress(t *testing.T) {
+	captures := []string{"api.example.com", "api", "eu.west"}
+	for addr, want := range map[string]string{
+		"10.0.0.1:443":        "10.0.0.1:443",
+		"$1.internal:443":     "api.internal:443",
+		"${1}-backend:443":    "api-backend:443",
+		"$2.$1.internal:8443": "eu.west.api.internal:8443",
+		"${0}:443":            "api.example.com:443",
+	} {
+		got, err := expandAddress(addr, captures)
+		if err != nil || got != want {
+			t.Errorf("%v expanded to %q, %v, want %q", addr, got, err, want)
+		}
+	}
+
+	for name, tt := range map[string]struct {
+		addr     string
+		captures []string
+	}{
+		"missing capture": {"$2.internal:443", []string{"api.example.com", "api"}},
+		"not a number":    {"$host:443", []string{"api.example.com", "api"}},
+		"empty capture":   {"$1.internal:443", []string{"example.com", ""}},
+		"port":            {"$1.internal:443", []string{"x", "a:22#"}},
+		"slash":           {"$1.internal:443", []string{"x", "a/b"}},
+		"upper case":      {"$1.internal:443", []string{"x", "API"}},
+	} {
+		if got, err := expandAddress(tt.addr, tt.captures); err == nil {
+			t.Errorf("%v: expanded to %q", name, got)
+		}
+	}
+}
+
+// A suffix route matched by its own domain captures nothing, which must not
+// turn into a backend address starting with a dot.
+func TestSuffixApexCapture(t *testing.T) {
+	var table routeTable
+	table.add(".example.com", &Listener{})
+	_, captures := table.match("example.com")
+	if got, err := expandAddress("$1.internal:443", captures); err == nil {
+		t.Errorf("apex expanded to %q", got)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Rule sends connections matching every one of its conditions to Frontend,
+// whatever their server name would otherwise route to. Empty conditions
+// match anything; within a condition any listed value may match. SNI takes
+// the same patterns as frontend names.
+type Rule struct {
+	Name        string   `yaml:"name"`
+	SNI         []string `yaml:"sni"`
+	Source      []string `yaml:"source"`
+	ALPN        []string `yaml:"alpn"`
+	TLSVersions []string `yaml:"tls_versions"` // 1.0, 1.1, 1.2 or 1.3
+	JA3         []string `yaml:"ja3"`
+	Frontend    string   `yaml:"frontend"`
+}
+
+// tlsVersions maps the version names used in the configuration to the
+// protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// nameMatcher matches server names like a frontend route would.
+type nameMatcher struct {
+	kind   routeKind
+	domain string
+	re     *regexp.Regexp
+}
+
+func (n nameMatcher) match(host string) bool {
+	switch n.kind {
+	case routeWildcard:
+		return strings.HasSuffix(host, "."+n.domain)
+	case routeSuffix:
+		return host == n.domain || strings.HasSuffix(host, "."+n.domain)
+	case routeRegex:
+		return n.re.MatchString(host)
+	}
+	return host == n.domain
+}
+
+// ruleInput holds the client attributes rules are matched against.
+type ruleInput struct {
+	Host     string
+	Source   net.IP
+	ALPN     []string
+	Version  uint16
+	JA3      string
+	protocol string
+	tls      bool
+}
+
+func ruleInputOf(conn Conn) ruleInput {
+	in := ruleInput{
+		Host:     normalize(conn.Host()),
+		Source:   addrIP(conn.RemoteAddr()),
+		protocol: conn.Protocol(),
+	}
+	if tlsConn, ok := conn.(*TLSConn); ok && tlsConn.ClientHelloMessage != nil {
+		hello := tlsConn.ClientHelloMessage
+		in.ALPN = hello.ALPNProtocols
+		in.Version = hello.Version()
+		in.JA3 = hello.JA3()
+		in.tls = true
+	}
+	return in
+}
+
+type rule struct {
+	name     string
+	sni      []nameMatcher
+	source   []*net.IPNet
+	alpn     []string
+	versions []uint16
+	ja3      []string
+	frontend string
+	protocol string // of the frontend, which only takes clients speaking it
+	hits     uint64
+}
+
+func newRule(i int, conf Rule) (*rule, error) {
+	r := &rule{
+		name:     conf.Name,
+		alpn:     conf.ALPN,
+		frontend: conf.Frontend,
+	}
+	r.protocol, _ = splitProtocol(conf.Frontend)
+	if r.name == "" {
+		r.name = fmt.Sprintf("rule %d", i+1)
+	}
+
+	for _, pattern := range conf.SNI {
+		if !isRegexRoute(pattern) {
+			pattern = normalize(pattern)
+		}
+		kind, domain, re, err := parseRoute(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", r.name, err)
+		}
+		r.sni = append(r.sni, nameMatcher{kind: kind, domain: domain, re: re})
+	}
+
+	var err error
+	if r.source, err = parseCIDRs(conf.Source); err != nil {
+		return nil, fmt.Errorf("%v: invalid source: %v", r.name, err)
+	}
+
+	for _, name := range conf.TLSVersions {
+		v, ok := tlsVersions[name]
+		if !ok {
+			return nil, fmt.Errorf("%v: unknown TLS version '%v'", r.name, name)
+		}
+		r.versions = append(r.versions, v)
+	}
+
+	for _, hash := range conf.JA3 {
+		r.ja3 = append(r.ja3, strings.ToLower(hash))
+	}
+
+	return r, nil
+}
+
+// ruleCheck is the outcome of one condition of a rule, as reported by
+// explain. Conditions the rule does not set are left out.
+type ruleCheck struct {
+	Condition string `json:"condition"`
+	Matched   bool   `json:"matched"`
+}
+
+// check evaluates every condition of the rule against in.
+func (r *rule) check(in ruleInput) (checks []ruleCheck, matched bool) {
+	matched = true
+	add := func(condition string, ok bool) {
+		checks = append(checks, ruleCheck{Condition: condition, Matched: ok})
+		matched = matched && ok
+	}
+
+	if len(r.sni) > 0 {
+		ok := false
+		for _, n := range r.sni {
+			ok = ok || n.match(in.Host)
+		}
+		add("sni", ok)
+	}
+	if len(r.source) > 0 {
+		ok := false
+		for _, n := range r.source {
+			ok = ok || (in.Source != nil && n.Contains(in.Source))
+		}
+		add("source", ok)
+	}
+	if len(r.alpn) > 0 {
+		ok := false
+		for _, want := range r.alpn {
+			for _, offered := range in.ALPN {
+				ok = ok || want == offered
+			}
+		}
+		add("alpn", in.tls && ok)
+	}
+	if len(r.versions) > 0 {
+		ok := false
+		for _, v := range r.versions {
+			ok = ok || v == in.Version
+		}
+		add("tls_versions", in.tls && ok)
+	}
+	if len(r.ja3) > 0 {
+		ok := false
+		for _, hash := range r.ja3 {
+			ok = ok || hash == in.JA3
+		}
+		add("ja3", in.tls && ok)
+	}
+	return
+}
+
+// ruleSet evaluates rules in order, the first match winning.
+type ruleSet struct {
+	rules []*rule
+}
+
+func newRuleSet(conf []Rule, frontends map[string]*Frontend) (*ruleSet, error) {
+	set := new(ruleSet)
+	for i, c := range conf {
+		r, err := newRule(i, c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule: %v", err)
+		}
+		front, ok := frontends[r.frontend]
+		if !ok {
+			return nil, fmt.Errorf("invalid rule: %v: unknown frontend '%v'", r.name, r.frontend)
+		}
+		// a rule matches names the frontend's pattern may not, so only the
+		// whole name is there to expand
+		for _, back := range front.Backends {
+			if err := checkAddress(back.Address, 1); err != nil {
+				return nil, fmt.Errorf("invalid rule: %v: frontend '%v' has backend '%v' using name captures, which rules cannot provide", r.name, r.frontend, back.Address)
+			}
+		}
+		set.rules = append(set.rules, r)
+	}
+	return set, nil
+}
+
+// match returns the first rule matching in among those whose frontend is
+// served and speaks the client's protocol, or nil.
+func (s *ruleSet) match(in ruleInput, served func(frontend string) bool) *rule {
+	if s == nil {
+		return nil
+	}
+	for _, r := range s.rules {
+		if r.protocol != in.protocol || !served(r.frontend) {
+			continue
+		}
+		if _, ok := r.check(in); ok {
+			atomic.AddUint64(&r.hits, 1)
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleCheck(t *testing.T) {
+	for _, tt := range []struct {
+		rule Rule
+		in   ruleInput
+		want bool
+	}{
+		{Rule{}, ruleInput{Host: "example.com"}, true},
+		{Rule{SNI: []string{"*.example.com"}}, ruleInput{Host: "api.example.com"}, true},
+		{Rule{SNI: []string{"*.example.com"}}, ruleInput{Host: "example.com"}, false},
+		{Rule{SNI: []string{"~^api[0-9]+\\.example\\.com$"}}, ruleInput{Host: "api1.example.com"}, true},
+		{Rule{Source: []string{"10.0.0.0/8"}}, ruleInput{Source: net.ParseIP("10.1.2.3")}, true},
+		{Rule{Source: []string{"10.0.0.0/8"}}, ruleInput{Source: net.ParseIP("192.0.2.1")}, false},
+		{Rule{ALPN: []string{"h2"}}, ruleInput{ALPN: []string{"http/1.1", "h2"}, tls: true}, true},
+		{Rule{ALPN: []string{"h2"}}, ruleInput{ALPN: []string{"h2"}}, false},
+		{Rule{TLSVersions: []string{"1.0", "1.1"}}, ruleInput{Version: tls.VersionTLS11, tls: true}, true},
+		{Rule{TLSVersions: []string{"1.0", "1.1"}}, ruleInput{Version: tls.VersionTLS13, tls: true}, false},
+		{Rule{JA3: []string{"E7D705A3286E19EA42F587B344EE6865"}}, ruleInput{JA3: "e7d705a3286e19ea42f587b344ee6865", tls: true}, true},
+		{Rule{SNI: []string{"example.com"}, ALPN: []string{"h2"}}, ruleInput{Host: "example.com", ALPN: []string{"http/1.1"}, tls: true}, false},
+	} {
+		r, err := newRule(0, tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, got := r.check(tt.in); got != tt.want {
+			t.Errorf("%+v against %+v: got %v, want %v", tt.rule, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRuleConfiguration(t *testing.T) {
+	for _, tt := range []struct {
+		rule    string
+		backend string
+		err     string
+	}{
+		{"{frontend: '*.example.com'}", "$0:443", ""},
+		{"{frontend: '*.example.com'}", "$1.internal:443", "name captures"},
+		{"{frontend: missing.example.com}", "127.0.0.1:1", "unknown frontend"},
+		{"{frontend: '*.example.com', tls_versions: ['1.4']}", "127.0.0.1:1", "unknown TLS version"},
+	} {
+		_, err := parseConfiguration([]byte(`
+port: 127.0.0.1:0
+rules:
+  - `+tt.rule+`
+frontends:
+  "*.example.com":
+    backends:
+      - addr: `+tt.backend+`
+`), loadTLSConfig)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%v to %v: %v", tt.rule, tt.backend, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%v to %v: got %v, want an error about %v", tt.rule, tt.backend, err, tt.err)
+		}
+	}
+}
+
+func TestRuleRoutesConnection(t *testing.T) {
+	mux := newTestMuxer(t)
+	named, err := mux.Listen("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := mux.Listen("b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := newRuleSet([]Rule{{Source: []string{"127.0.0.0/8"}, Frontend: "b.example.com"}}, map[string]*Frontend{
+		"b.example.com": {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.SetRules(rules, map[string]*Listener{"b.example.com": target.(*Listener)})
+
+	c, err := net.Dial("tcp", mux.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write(clientHelloRecord(tls.VersionTLS12, "a.example.com"))
+
+	accepted := make(chan net.Listener, 2)
+	for _, l := range []net.Listener{named, target} {
+		go func(l net.Listener) {
+			if conn, err := l.Accept(); err == nil {
+				conn.Close()
+				accepted <- l
+			}
+		}(l)
+	}
+	select {
+	case l := <-accepted:
+		if l != target {
+			t.Error("connection went to its server name instead of the rule's frontend")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not routed")
+	}
+	if hits := rules.rules[0].hits; hits != 1 {
+		t.Errorf("rule has %v hits, want 1", hits)
+	}
+}
+
+func TestExplainWithoutTCPListener(t *testing.T) {
+	s := &Server{Configuration: &Configuration{}}
+	w := httptest.NewRecorder()
+	s.handleExplain(w, httptest.NewRequest("GET", "/rules/explain?sni=example.com", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"github.com/inconshreveable/go-vhost"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -16,39 +25,46 @@ const (
 )
 
 type Server struct {
-	*log.Logger
+	*slog.Logger
 	*Configuration
-	wait sync.WaitGroup
+	wait      sync.WaitGroup
+	logOutput io.Writer
 
-	mux   *TLSMuxer
-	ready chan int
-}
+	lock      sync.Mutex
+	listeners []io.Closer
+	closing   bool
+	sessions  *sessionSet
+	shutdown  sync.Once
 
-func (s *Server) Redirect() {
-	redirect := func(w http.ResponseWriter, req *http.Request) {
-		target := "https://" + req.Host + req.URL.Path
-		if len(req.URL.RawQuery) > 0 {
-			target += "?" + req.URL.RawQuery
-		}
-		log.Printf("redirect to: %s", target)
-		http.Redirect(w, req, target,
-			// see comments below and consider the codes 308, 302, or 301
-			http.StatusTemporaryRedirect)
-	}
-	go http.ListenAndServe(":80", http.HandlerFunc(redirect))
-	s.Println("Serving connections on [::]:80")
+	inherited        map[string]net.Listener
+	inheritedPackets map[string]net.PacketConn
+	upgradable       map[string]io.Closer
+	upgrading        int32
+	nextID           uint64 // connection IDs, shared by every listener
+
+	muxes     []*muxListener
+	redirect  *http.Server
+	metrics   *metrics
+	accessLog *accessLogger
+
+	tracer         trace.Tracer
+	tracerProvider *sdktrace.TracerProvider
+	spanExporter   sdktrace.SpanExporter // overrides the OTLP exporter, for tests
+	ready          chan int
 }
 
 func (s *Server) frontend(name string, front *Frontend, l net.Listener) {
 	defer s.wait.Done()
 
-	front.strategy = &RoundRobin{backends: front.Backends}
-
-	s.Printf("Handling connections for %v", name)
+	front.logger.Info("handling connections")
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			s.Printf("Failed to accept new connection for '%v': %v", conn.RemoteAddr(), err)
+			if _, ok := err.(Closed); ok {
+				front.logger.Debug("stopped handling connections", "err", err)
+				return
+			}
+			front.logger.Error("failed to accept new connection", "err", err)
 			if e, ok := err.(net.Error); ok {
 				if e.Temporary() {
 					continue
@@ -56,100 +72,439 @@ func (s *Server) frontend(name string, front *Frontend, l net.Listener) {
 			}
 			return
 		}
-		s.Printf("Accepted new connection for %v from %v", name, conn.RemoteAddr())
-		go s.proxy(conn, front)
+		front.logger.Debug("accepted new connection", "conn", connID(conn), "remote", conn.RemoteAddr())
+		s.handOff(conn, front)
 	}
 }
 
-func (s *Server) proxy(conn net.Conn, front *Frontend) (err error) {
-	if front.tlsConfig != nil {
-		conn = tls.Server(conn, front.tlsConfig)
+// handOff proxies conn to front in the background. The connection counts as
+// a live session from here on, so a drain waits for it even while the TLS
+// handshake or the backend dial is still going on.
+func (s *Server) handOff(conn net.Conn, front *Frontend) {
+	sess := &session{client: conn, front: front}
+	s.sessions.add(sess)
+	go func() {
+		defer s.sessions.remove(sess)
+		s.proxy(conn, front, sess)
+	}()
+}
+
+func (s *Server) proxy(conn net.Conn, front *Frontend, sess *session) (err error) {
+	logger := front.logger.With("conn", connID(conn))
+
+	var info proxyInfo
+	var hello *ClientHelloMessage
+	if tlsConn, ok := conn.(*TLSConn); ok && tlsConn.ClientHelloMessage != nil {
+		hello = tlsConn.ClientHelloMessage
+		info.ServerName = hello.ServerName
+		info.Version = hello.Version()
+		if len(hello.ALPNProtocols) > 0 {
+			info.ALPN = hello.ALPNProtocols[0]
+		}
+	}
+
+	entry := &accessLogEntry{
+		Time:     time.Now(),
+		ID:       connID(conn),
+		Client:   conn.RemoteAddr(),
+		Frontend: front.name,
+	}
+	if hello != nil {
+		entry.SNI = hello.ServerName
+		entry.ALPN = strings.Join(hello.ALPNProtocols, ",")
+		entry.JA3 = hello.JA3()
 	}
 
-	backend := front.strategy.NextBackend()
+	ctx, span := traceMuxer(s.tracer, metaOf(conn),
+		attribute.Int64("tlsmux.conn_id", int64(entry.ID)),
+		attribute.String("tlsmux.frontend", front.name),
+		attribute.String("tls.server_name", entry.SNI),
+		attribute.String("client.address", entry.Client.String()))
+	defer func() { endSpan(span, err) }()
 
-	upConn, err := net.DialTimeout("tcp", backend.Address, time.Duration(backend.ConnectTimeout)*time.Millisecond)
+	if hello != nil && hello.Version() < front.minVersion {
+		logger.Warn("rejected connection", "remote", conn.RemoteAddr(), "reason", "TLS version too old", "version", fmt.Sprintf("%#04x", hello.Version()))
+		if s.alerts.badVersion != 0 {
+			writeAlert(conn, hello, s.alerts.badVersion)
+		}
+		conn.Close()
+		return fmt.Errorf("TLS version %#04x below the frontend's minimum", hello.Version())
+	}
+
+	if !front.rate.allow(time.Now()) {
+		return s.reject(logger, conn, hello, "connection rate limit exceeded for frontend")
+	}
+
+	if !front.conns.acquire() {
+		return s.reject(logger, conn, hello, "too many connections to frontend")
+	}
+	defer front.conns.release()
+
+	frontActive := s.metrics.frontendActive.WithLabelValues(front.name)
+	frontActive.Inc()
+	defer frontActive.Dec()
+
+	backend, ok := s.nextBackend(front)
+	if !ok {
+		return s.reject(logger, conn, hello, "too many connections to every backend")
+	}
+	defer backend.conns.release()
+
+	var captures []string
+	if m := metaOf(conn); m != nil {
+		captures = m.captures
+	}
+	address, err := expandAddress(backend.Address, captures)
 	if err != nil {
-		s.Printf("Failed to dial backend connection %v %v: %v", backend.Protocol, backend.Address, err)
+		logger.Warn("failed to resolve backend address", "backend", backend.Address, "err", err)
 		conn.Close()
 		return
 	}
+	span.SetAttributes(attribute.String("tlsmux.backend", address))
+
+	backActive := s.metrics.backendActive.WithLabelValues(front.name, backend.Address)
+	backActive.Inc()
+	defer backActive.Dec()
 
-	s.Printf("Initiated new connection to backend: %v %v", upConn.LocalAddr(), upConn.RemoteAddr())
+	keepAlive := time.Duration(front.KeepAlive) * time.Millisecond
+	setKeepAlive(conn, keepAlive)
 
-	s.joinConnections(conn, upConn)
+	if front.tlsConfig != nil {
+		tlsConn := tls.Server(conn, front.tlsConfig)
+		_, handshake := s.tracer.Start(ctx, "tlsmux.tls_handshake")
+		if err = conn.SetDeadline(time.Now().Add(time.Duration(front.HandshakeTimeout) * time.Millisecond)); err == nil {
+			if err = tlsConn.Handshake(); err == nil {
+				err = conn.SetDeadline(time.Time{})
+			}
+		}
+		endSpan(handshake, err)
+		if err != nil {
+			logger.Warn("TLS handshake failed", "remote", conn.RemoteAddr(), "err", err)
+			conn.Close()
+			return
+		}
+		conn = tlsConn
+	}
+
+	_, dial := s.tracer.Start(ctx, "tlsmux.dial", trace.WithAttributes(attribute.String("tlsmux.backend", address)))
+	dialStart := time.Now()
+	dialer := net.Dialer{
+		Timeout:   time.Duration(backend.ConnectTimeout) * time.Millisecond,
+		KeepAlive: keepAlive,
+	}
+	upConn, err := dialer.Dial("tcp", address)
+	endSpan(dial, err)
+	entry.Backend = address
+	entry.DialTime = time.Since(dialStart)
+	s.metrics.dialDuration.WithLabelValues(front.name, backend.Address).Observe(entry.DialTime.Seconds())
+	if err != nil {
+		s.metrics.dialErrors.WithLabelValues(front.name, backend.Address).Inc()
+		s.metrics.backendUp.WithLabelValues(front.name, backend.Address).Set(0)
+		logger.Error("failed to dial backend", "protocol", backend.Protocol, "backend", address, "err", err)
+		conn.Close()
+		return
+	}
+	s.metrics.backendUp.WithLabelValues(front.name, backend.Address).Set(1)
+
+	if !s.sessions.attach(sess, upConn, backend) {
+		logger.Debug("connection closed while dialing", "backend", address)
+		upConn.Close()
+		return
+	}
+
+	logger.Debug("initiated new connection to backend", "local", upConn.LocalAddr(), "backend", upConn.RemoteAddr())
+
+	if backend.SendProxy != "" {
+		if err = s.sendProxyHeader(conn, upConn, backend, info); err != nil {
+			logger.Error("failed to send PROXY header", "backend", backend.Address, "err", err)
+			conn.Close()
+			upConn.Close()
+			return
+		}
+	}
+
+	_, session := s.tracer.Start(ctx, "tlsmux.session")
+	s.joinConnections(logger, conn, upConn, front, backend, entry)
+	session.SetAttributes(
+		attribute.Int64("tlsmux.bytes_in", entry.BytesIn),
+		attribute.Int64("tlsmux.bytes_out", entry.BytesOut),
+		attribute.String("tlsmux.close_reason", entry.CloseReason))
+	session.End()
 	return
 }
 
-func (s *Server) joinConnections(c1 net.Conn, c2 net.Conn) {
+// nextBackend picks the next backend from the frontend's strategy that is
+// below its connection cap, giving every backend one chance.
+func (s *Server) nextBackend(front *Frontend) (Backend, bool) {
+	for i := 0; i < len(front.Backends); i++ {
+		backend := front.strategy.NextBackend()
+		if backend.state.isDraining() {
+			continue
+		}
+		if backend.conns.acquire() {
+			return backend, true
+		}
+	}
+	return Backend{}, false
+}
+
+// reject closes a connection refused by a limit, telling TLS clients why when
+// their ClientHello has already been read. It returns reason as an error.
+func (s *Server) reject(logger *slog.Logger, conn net.Conn, hello *ClientHelloMessage, reason string) error {
+	logger.Warn("rejected connection", "remote", conn.RemoteAddr(), "reason", reason)
+	if hello != nil && s.alerts.overloaded != 0 {
+		writeAlert(conn, hello, s.alerts.overloaded)
+	}
+	conn.Close()
+	return errors.New(reason)
+}
+
+// sendProxyHeader writes the PROXY header for conn to upConn. Terminated
+// connections are handshaken first so that the negotiated ALPN and version are
+// reported rather than the client's first preference.
+func (s *Server) sendProxyHeader(conn, upConn net.Conn, backend Backend, info proxyInfo) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %v", err)
+		}
+		state := tlsConn.ConnectionState()
+		info.ALPN = state.NegotiatedProtocol
+		info.Version = state.Version
+		if state.ServerName != "" {
+			info.ServerName = state.ServerName
+		}
+	}
+
+	return writeProxyHeader(upConn, backend.SendProxy, conn.RemoteAddr(), conn.LocalAddr(), info)
+}
+
+// joinConnections copies between the client c1 and the backend c2 until both
+// directions are done, then completes and writes the access log entry. When
+// one side finishes sending, the write half of the other side is closed so
+// that half-closing protocols keep working; the remaining direction then lives
+// for as long as it never goes quiet for the frontend's half-close timeout.
+// Errors tear down both.
+func (s *Server) joinConnections(logger *slog.Logger, c1 net.Conn, c2 net.Conn, front *Frontend, backend Backend, entry *accessLogEntry) {
 	var wg sync.WaitGroup
-	halfJoin := func(dst net.Conn, src net.Conn) {
+	var closed sync.Once
+	var halfClosed int32 // set once either direction has finished
+	halfCloseTimeout := time.Duration(front.HalfCloseTimeout) * time.Millisecond
+
+	// the idle timeout and bandwidth limits need to watch every read and
+	// write, which rules out splicing; the session timeout does not
+	clientUpload, clientDownload := s.clientBandwidth.buckets(c1.RemoteAddr())
+	client := shape(c1, front.upload, backend.upload, clientUpload)
+	upstream := shape(c2, front.download, backend.download, clientDownload)
+	if front.IdleTimeout > 0 {
+		idle := time.Duration(front.IdleTimeout) * time.Millisecond
+		clock := newActivityClock()
+		client = &idleConn{Conn: client, idle: idle, clock: clock}
+		upstream = &idleConn{Conn: upstream, idle: idle, clock: clock}
+	}
+
+	if front.SessionTimeout > 0 {
+		timer := time.AfterFunc(time.Duration(front.SessionTimeout)*time.Millisecond, func() {
+			closed.Do(func() { entry.CloseReason = "session timeout" })
+			c1.Close()
+			c2.Close()
+		})
+		defer timer.Stop()
+	}
+	halfJoin := func(dst net.Conn, src net.Conn, direction, peer string, count *int64) {
 		defer wg.Done()
-		defer dst.Close()
-		defer src.Close()
-		n, err := io.Copy(dst, src)
-		s.Printf("Copy from %v to %v failed after %d bytes with error %v", src.RemoteAddr(), dst.RemoteAddr(), n, err)
+		counter := s.metrics.bytes.WithLabelValues(front.name, backend.Address, direction)
+		clock := newActivityClock()
+		progress := func(n int64) {
+			counter.Add(float64(n))
+			if n > 0 && atomic.LoadInt32(&halfClosed) == 1 {
+				clock.touch()
+				src.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+			}
+		}
+
+		var n int64
+		var err error
+		for {
+			var m int64
+			m, err = proxyCopy(dst, src, progress)
+			n += m
+			// a splice only reports progress once it returns, so the
+			// half-close deadline can interrupt one that is still busy
+			if !isTimeout(err) || atomic.LoadInt32(&halfClosed) == 0 || clock.since() >= halfCloseTimeout {
+				break
+			}
+		}
+		*count = n
+		first := false
+		closed.Do(func() {
+			first = true
+			entry.CloseReason = peer + " closed"
+			if err != nil {
+				entry.CloseReason = fmt.Sprintf("%s error: %v", peer, err)
+			}
+		})
+
+		if err == nil {
+			err = closeWrite(dst)
+		}
+		if err != nil {
+			dst.Close()
+			src.Close()
+		} else if first {
+			atomic.StoreInt32(&halfClosed, 1)
+			dst.SetReadDeadline(time.Now().Add(halfCloseTimeout))
+		}
+
+		logger.Debug("copy finished", "src", src.RemoteAddr(), "dst", dst.RemoteAddr(), "bytes", n, "err", err)
 	}
 
-	s.Printf("Joining connections: %v %v", c1.RemoteAddr(), c2.RemoteAddr())
+	logger.Debug("joining connections", "client", c1.RemoteAddr(), "backend", c2.RemoteAddr())
 	wg.Add(2)
-	go halfJoin(c1, c2)
-	go halfJoin(c2, c1)
+	go halfJoin(client, upstream, "out", "backend", &entry.BytesOut)
+	go halfJoin(upstream, client, "in", "client", &entry.BytesIn)
 	wg.Wait()
+	c1.Close()
+	c2.Close()
+
+	entry.Duration = time.Since(entry.Time)
+	if tlsConn, ok := c1.(*tls.Conn); ok {
+		entry.ALPN = tlsConn.ConnectionState().NegotiatedProtocol
+	}
+	if err := s.accessLog.log(entry); err != nil {
+		logger.Error("failed to write access log", "err", err)
+	}
+}
+
+func (s *Server) serveMetrics(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle(s.Metrics.Path, s.metrics.handler())
+
+	s.Info("serving metrics", "addr", l.Addr(), "path", s.Metrics.Path)
+	if err := http.Serve(l, mux); err != nil {
+		s.Error("failed to serve metrics", "err", err)
+	}
 }
 
 func (s *Server) Run() (err error) {
-	if s.Configuration.Redirect {
-		s.Redirect()
+	s.metrics = newMetrics()
+	s.sessions = newSessionSet()
+
+	s.tracer = noopTracer()
+	if s.Tracing != nil {
+		if s.tracerProvider, err = newTracerProvider(s.Tracing, s.spanExporter); err != nil {
+			return err
+		}
+		s.tracer = s.tracerProvider.Tracer(tracerName)
 	}
 
-	l, err := net.Listen(s.Configuration.Protocol, s.Configuration.Port)
-	if err != nil {
-		return err
+	if s.AccessLog != nil {
+		if s.accessLog, err = newAccessLogger(s.AccessLog); err != nil {
+			return err
+		}
 	}
-	s.Printf("Serving connections on %v", l.Addr())
 
-	s.mux, err = NewTLSMuxer(l, muxTimeout)
-	if err != nil {
+	if s.inherited, s.inheritedPackets, err = inheritedListeners(); err != nil {
 		return err
 	}
 
-	s.wait.Add(len(s.Frontends))
+	if s.Configuration.Redirect.Enabled {
+		if err = s.serveRedirect(); err != nil {
+			return err
+		}
+	}
+
+	if len(s.proxyTrusted) > 0 && !s.Sniff.Proxy {
+		s.Info("accepting PROXY protocol headers", "trusted", s.AcceptProxy)
+	}
+
+	if s.Sniff.enabled() {
+		s.Info("sniffing protocols", "http", s.Sniff.HTTP, "ssh", s.Sniff.SSH, "proxy", s.Sniff.Proxy)
+	}
 
-	for name, front := range s.Frontends {
-		fl, err := s.mux.Listen(name)
+	if s.ticketKeys != nil {
+		go s.ticketKeys.run(s.Logger)
+	}
+
+	if s.ocsp != nil {
+		s.ocsp.run(s.Logger)
+	}
+
+	if s.logOutput == nil {
+		s.logOutput = os.Stdout
+	}
+
+	var acls []*accessList
+	if s.acl != nil {
+		acls = append(acls, s.acl)
+		go s.acl.watch(s.Logger)
+	}
+	for _, name := range s.frontendOrder {
+		front := s.Frontends[name]
+		level, _ := parseLogLevel(front.LogLevel)
+		front.logger = newLogger(s.logOutput, s.Logging.Format, level).With("frontend", name)
+		front.strategy = &RoundRobin{backends: front.Backends}
+		if front.acl != nil {
+			acls = append(acls, front.acl)
+			go front.acl.watch(s.Logger)
+		}
+	}
+
+	for _, conf := range s.Listeners {
+		if isPacketProtocol(conf.Protocol) {
+			if err = s.serveQUIC(conf); err != nil {
+				return err
+			}
+			continue
+		}
+		ml, err := s.serveListener(conf)
 		if err != nil {
 			return err
 		}
-		go s.frontend(name, front, fl)
+		s.muxes = append(s.muxes, ml)
 	}
+	s.metrics.registry.MustRegister(newStatsCollector(s.muxes, acls))
 
-	go func() {
-		for {
-			conn, err := s.mux.NextError()
+	if s.Metrics.Address != "" {
+		ml, err := s.listen("metrics", "tcp", s.Metrics.Address)
+		if err != nil {
+			return err
+		}
+		go s.serveMetrics(ml)
+	}
 
-			if conn == nil {
-				s.Printf("failed to mux next connection, error: %v", err)
-				if _, ok := err.(vhost.Closed); ok {
-					return
-				} else {
-					continue
-				}
-			} else {
-				if _, ok := err.(vhost.NotFound); ok && s.defaultFrontend != nil {
-					go s.proxy(conn, s.defaultFrontend)
-				} else {
-					s.Printf("failed to mux connection from %v, error: %v", conn.RemoteAddr(), err)
-				}
-			}
+	if s.Admin.Address != "" {
+		al, err := s.listen("admin", "tcp", s.Admin.Address)
+		if err != nil {
+			return err
 		}
-	}()
+		go s.serveAdmin(al)
+	}
+
+	s.lock.Lock()
+	for name, l := range s.inherited {
+		s.Warn("closing unused inherited listener", "name", name, "addr", l.Addr())
+		l.Close()
+	}
+	for name, pc := range s.inheritedPackets {
+		s.Warn("closing unused inherited listener", "name", name, "addr", pc.LocalAddr())
+		pc.Close()
+	}
+	s.lock.Unlock()
 
 	if s.ready != nil {
 		close(s.ready)
 	}
+	s.notifyReady()
 
 	s.wait.Wait()
+	s.stopRedirect()
+	s.drain()
+
+	if s.tracerProvider != nil {
+		if err = s.tracerProvider.Shutdown(context.Background()); err != nil {
+			s.Error("failed to flush traces", "err", err)
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// streamAfterCloseServer is a TLS backend that waits for the client to finish
+// sending, then writes chunks every interval, count times, before closing.
+func streamAfterCloseServer(t *testing.T, chunk []byte, count int, interval time.Duration) string {
+	cert := newTestCA(t).issue(t, "", "example.com")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(io.Discard, c)
+				for i := 0; i < count; i++ {
+					time.Sleep(interval)
+					if _, err := c.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func testHalfCloseTimeoutIsIdle(t *testing.T, idleTimeout int) {
+	const count = 12
+	chunk := []byte("tlsmux")
+	backend := streamAfterCloseServer(t, chunk, count, 50*time.Millisecond)
+	s := startServer(t, `
+port: 127.0.0.1:0
+frontends:
+  example.com:
+    half_close_timeout: 200
+    idle_timeout: %v
+    backends:
+      - addr: %v
+`, nil, idleTimeout, backend)
+
+	raw, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	c := tls.Client(raw, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.CloseWrite()
+	raw.(*net.TCPConn).CloseWrite()
+
+	// the backend streams for three times the half-close timeout
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat(chunk, count); !bytes.Equal(got, want) {
+		t.Errorf("received %v bytes after half-closing, want %v", len(got), len(want))
+	}
+}
+
+func TestHalfCloseTimeoutIsIdleSplice(t *testing.T) {
+	testHalfCloseTimeoutIsIdle(t, 0)
+}
+
+func TestHalfCloseTimeoutIsIdleBuffered(t *testing.T) {
+	testHalfCloseTimeoutIsIdle(t, 5000)
+}
+
+func TestHalfCloseTimeoutExpires(t *testing.T) {
+	backend := streamAfterCloseServer(t, []byte("tlsmux"), 1, 2*time.Second)
+	s := startServer(t, `
+port: 127.0.0.1:0
+frontends:
+  example.com:
+    half_close_timeout: 200
+    backends:
+      - addr: %v
+`, nil, backend)
+
+	raw, err := net.Dial("tcp", s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	c := tls.Client(raw, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.CloseWrite()
+	raw.(*net.TCPConn).CloseWrite()
+
+	start := time.Now()
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.Copy(io.Discard, raw)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("quiet half-closed session lasted %v", elapsed)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTicketRotate = 3600 // seconds
+	defaultTicketKeep   = 2    // previous keys still accepted for resumption
+	ticketKeyLen        = 32
+
+	ticketReloadInterval = 10 * time.Second
+)
+
+// SessionTickets configures the session ticket keys shared by every frontend
+// that terminates TLS. The key file holds one base64 encoded 32 byte key per
+// line, the first of which is used to encrypt new tickets; the rest are only
+// used to decrypt tickets issued before the last rotation.
+//
+// To share keys between several tlsmux instances, point them all at the same
+// key file and set generate on exactly one of them; the others reload the file
+// as soon as it changes. Keep defaults to 2 when left out.
+type SessionTickets struct {
+	KeyFile  string `yaml:"key_file"`
+	Rotate   int    `yaml:"rotate"`
+	Keep     *int   `yaml:"keep"`
+	Generate bool   `yaml:"generate"`
+}
+
+type ticketKeyManager struct {
+	sync.Mutex
+	*SessionTickets
+	keep    int
+	keys    [][ticketKeyLen]byte
+	mtime   time.Time
+	configs []*tls.Config
+}
+
+func newTicketKeyManager(conf *SessionTickets) (*ticketKeyManager, error) {
+	if conf.Rotate == 0 {
+		conf.Rotate = defaultTicketRotate
+	}
+
+	m := &ticketKeyManager{SessionTickets: conf, keep: defaultTicketKeep}
+	if conf.Keep != nil {
+		m.keep = *conf.Keep
+	}
+
+	if conf.Rotate < 0 || m.keep < 0 {
+		return nil, fmt.Errorf("session ticket rotate and keep must not be negative")
+	}
+
+	if conf.KeyFile != "" {
+		err := m.load()
+		switch {
+		case err == nil:
+			return m, nil
+		case !os.IsNotExist(err) || !conf.Generate:
+			return nil, fmt.Errorf("failed to load session ticket keys: %v", err)
+		}
+	}
+
+	if err := m.generate(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// generates reports whether this instance owns key generation, as opposed to
+// following a key file written by someone else.
+func (m *ticketKeyManager) generates() bool {
+	return m.Generate || m.KeyFile == ""
+}
+
+// add registers a TLS configuration that should track the current keys.
+func (m *ticketKeyManager) add(config *tls.Config) {
+	m.Lock()
+	defer m.Unlock()
+	m.configs = append(m.configs, config)
+	config.SetSessionTicketKeys(m.keys)
+}
+
+func (m *ticketKeyManager) generate() error {
+	var key [ticketKeyLen]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("failed to generate session ticket key: %v", err)
+	}
+
+	keys := append([][ticketKeyLen]byte{key}, m.keys...)
+	if len(keys) > m.keep+1 {
+		keys = keys[:m.keep+1]
+	}
+
+	if m.KeyFile != "" {
+		if err := writeTicketKeys(m.KeyFile, keys); err != nil {
+			return fmt.Errorf("failed to write session ticket keys: %v", err)
+		}
+	}
+
+	m.keys = keys
+	return nil
+}
+
+// load reads the key file, remembering when it was last modified.
+func (m *ticketKeyManager) load() error {
+	info, err := os.Stat(m.KeyFile)
+	if err != nil {
+		return err
+	}
+	keys, err := readTicketKeys(m.KeyFile)
+	if err != nil {
+		return err
+	}
+	m.keys, m.mtime = keys, info.ModTime()
+	return nil
+}
+
+// changed reports whether the key file was modified since it was last loaded.
+func (m *ticketKeyManager) changed() bool {
+	m.Lock()
+	defer m.Unlock()
+	info, err := os.Stat(m.KeyFile)
+	return err == nil && !info.ModTime().Equal(m.mtime)
+}
+
+func (m *ticketKeyManager) rotate() (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.generates() {
+		err = m.generate()
+	} else {
+		err = m.load()
+	}
+	if err != nil {
+		return
+	}
+
+	for _, config := range m.configs {
+		config.SetSessionTicketKeys(m.keys)
+	}
+	return
+}
+
+// run rotates the keys. Instances following a key file written by someone
+// else instead reload it whenever it changes, so they never fall a rotation
+// behind the generator.
+func (m *ticketKeyManager) run(logger *slog.Logger) {
+	follow := !m.generates()
+	interval := time.Duration(m.Rotate) * time.Second
+	if follow && interval > ticketReloadInterval {
+		interval = ticketReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if follow && !m.changed() {
+			continue
+		}
+		if err := m.rotate(); err != nil {
+			logger.Error("failed to rotate session ticket keys", "err", err)
+			continue
+		}
+		logger.Info("rotated session ticket keys")
+	}
+}
+
+func readTicketKeys(path string) ([][ticketKeyLen]byte, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][ticketKeyLen]byte
+	for i, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		if len(raw) != ticketKeyLen {
+			return nil, fmt.Errorf("%s:%d: key must be %d bytes, got %d", path, i+1, ticketKeyLen, len(raw))
+		}
+
+		var key [ticketKeyLen]byte
+		copy(key[:], raw)
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no session ticket keys found", path)
+	}
+
+	return keys, nil
+}
+
+// writeTicketKeys replaces the key file atomically so that instances reloading
+// it never observe a partial write.
+func writeTicketKeys(path string, keys [][ticketKeyLen]byte) error {
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(base64.StdEncoding.EncodeToString(key[:]))
+		b.WriteByte('\n')
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = tmp.WriteString(b.String())
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
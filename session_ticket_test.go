@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTicketKeys(t *testing.T) {
+	dir := t.TempDir()
+	key := base64.StdEncoding.EncodeToString(make([]byte, ticketKeyLen))
+	for name, tt := range map[string]struct {
+		content string
+		keys    int
+	}{
+		"valid":      {"# current first\n" + key + "\n\n  " + key + "  \n", 2},
+		"not base64": {"not base64!\n", 0},
+		"short key":  {base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\n", 0},
+		"no keys":    {"# nothing yet\n", 0},
+	} {
+		path := filepath.Join(dir, strings.ReplaceAll(name, " ", "_"))
+		os.WriteFile(path, []byte(tt.content), 0o600)
+		keys, err := readTicketKeys(path)
+		if tt.keys == 0 {
+			if err == nil {
+				t.Errorf("%v: read %v keys", name, len(keys))
+			}
+		} else if err != nil || len(keys) != tt.keys {
+			t.Errorf("%v: read %v keys, %v, want %v", name, len(keys), err, tt.keys)
+		}
+	}
+}
+
+func TestTicketKeyRotation(t *testing.T) {
+	for _, keep := range []int{0, 2} {
+		path := filepath.Join(t.TempDir(), "tickets")
+		m, err := newTicketKeyManager(&SessionTickets{KeyFile: path, Generate: true, Keep: &keep})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every key generated so far, newest first
+		var generated [][ticketKeyLen]byte
+		for i := 0; i < 4; i++ {
+			if i > 0 {
+				if err := m.rotate(); err != nil {
+					t.Fatal(err)
+				}
+				if m.keys[0] == generated[0] {
+					t.Fatalf("keep %v: rotation kept the current key", keep)
+				}
+			}
+			generated = append([][ticketKeyLen]byte{m.keys[0]}, generated...)
+
+			want := len(generated)
+			if want > keep+1 {
+				want = keep + 1
+			}
+			if len(m.keys) != want {
+				t.Fatalf("keep %v: %v keys after %v rotations, want %v", keep, len(m.keys), i, want)
+			}
+			for j := range m.keys {
+				if m.keys[j] != generated[j] {
+					t.Errorf("keep %v: key %v after %v rotations is not the one generated %v rotations before", keep, j, i, j)
+				}
+			}
+
+			written, err := readTicketKeys(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(written) != len(m.keys) || written[0] != m.keys[0] {
+				t.Errorf("keep %v: key file does not hold the current keys", keep)
+			}
+		}
+	}
+}
+
+func TestTicketKeyFileMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets")
+	if _, err := newTicketKeyManager(&SessionTickets{KeyFile: path}); err == nil {
+		t.Error("follower started without a key file")
+	}
+	keep := -1
+	if _, err := newTicketKeyManager(&SessionTickets{Keep: &keep}); err == nil {
+		t.Error("negative keep was accepted")
+	}
+}
+
+func TestTicketKeyFollower(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tickets")
+	generator, err := newTicketKeyManager(&SessionTickets{KeyFile: path, Generate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := newTicketKeyManager(&SessionTickets{KeyFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if follower.generates() {
+		t.Fatal("follower generates keys")
+	}
+	if follower.keys[0] != generator.keys[0] {
+		t.Fatal("follower did not load the generator's key")
+	}
+	if follower.changed() {
+		t.Error("key file changed before a rotation")
+	}
+
+	if err := generator.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+	if !follower.changed() {
+		t.Fatal("follower did not notice the rotation")
+	}
+	if err := follower.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(follower.keys) != 2 || follower.keys[0] != generator.keys[0] || follower.keys[1] != generator.keys[1] {
+		t.Error("follower did not reload the rotated keys")
+	}
+
+	// a broken file leaves the follower on its current keys
+	current := follower.keys
+	os.WriteFile(path, []byte("garbage\n"), 0o600)
+	if err := follower.rotate(); err == nil {
+		t.Error("broken key file was loaded")
+	}
+	if follower.keys[0] != current[0] {
+		t.Error("follower dropped its keys on a failed reload")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Sniff lets the listener take protocols other than TLS. HTTP connections
+// are routed by their Host header to frontends named http://<host>, SSH
+// connections to the frontend named ssh://. With Proxy set, connections from
+// accept_proxy sources may, rather than must, start with a PROXY header.
+// The global acl and rate_limit then apply to the address the header carries.
+type Sniff struct {
+	HTTP  bool `yaml:"http"`
+	SSH   bool `yaml:"ssh"`
+	Proxy bool `yaml:"proxy"`
+}
+
+func (s Sniff) enabled() bool {
+	return s.HTTP || s.SSH || s.Proxy
+}
+
+const (
+	sniffLimit     = 1 << 17 // bytes read at most while sniffing, fits any ClientHello
+	maxSSHBanner   = 255
+	sshBannerStart = "SSH-"
+)
+
+// sniffError wraps failures to read a protocol other than TLS, so that such
+// clients are not sent TLS alerts.
+type sniffError struct {
+	protocol string
+	err      error
+}
+
+func (e sniffError) Error() string {
+	return e.protocol + ": " + e.err.Error()
+}
+
+func (e sniffError) Unwrap() error {
+	return e.err
+}
+
+type HTTPConn struct {
+	*sharedConn
+	host string
+}
+
+func (c *HTTPConn) Host() string {
+	return c.host
+}
+
+func (c *HTTPConn) Protocol() string {
+	return protoHTTP
+}
+
+func (c *HTTPConn) Free() {}
+
+type SSHConn struct {
+	*sharedConn
+	Banner string
+}
+
+func (c *SSHConn) Host() string {
+	return ""
+}
+
+func (c *SSHConn) Protocol() string {
+	return protoSSH
+}
+
+func (c *SSHConn) Free() {}
+
+type sniffer struct {
+	Sniff
+	trusted []*net.IPNet
+}
+
+// NewSniffingMuxer is like NewTLSMuxer but also recognizes the protocols
+// enabled in conf. Anything unrecognized is still read as TLS.
+func NewSniffingMuxer(listener net.Listener, limits HandshakeLimits, ids *uint64, conf Sniff, trusted []*net.IPNet) (*TLSMuxer, error) {
+	s := &sniffer{Sniff: conf, trusted: trusted}
+	mux, err := NewMuxer(listener, s.sniff, limits, ids)
+	if conf.Proxy {
+		mux.SetProxies(trusted)
+	}
+	return &TLSMuxer{mux}, err
+}
+
+func (s *sniffer) sniff(conn net.Conn) (Conn, error) {
+	c, rd := newSharedConn(conn)
+	return s.next(c, bufio.NewReader(io.LimitReader(rd, sniffLimit)), s.Proxy)
+}
+
+// next looks at the first bytes buffered in br to pick the protocol of c.
+// Every byte read through br is replayed unless it belonged to a PROXY
+// header.
+func (s *sniffer) next(c *sharedConn, br *bufio.Reader, proxy bool) (Conn, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case proxy && (first[0] == 'P' || first[0] == proxyV2Signature[0]):
+		if sig, _ := br.Peek(6); string(sig) == "PROXY " || bytes.Equal(sig, proxyV2Signature[:6]) {
+			if err := s.readProxy(c, br); err != nil {
+				return nil, sniffError{"proxy", err}
+			}
+			return s.next(c, br, false)
+		}
+	case s.SSH && first[0] == sshBannerStart[0]:
+		if sig, _ := br.Peek(len(sshBannerStart)); string(sig) == sshBannerStart {
+			return readSSHBanner(c, br)
+		}
+	}
+
+	if s.HTTP && isHTTPMethodStart(first[0]) {
+		return readHTTPHost(c, br)
+	}
+
+	tlsConn := &TLSConn{sharedConn: c}
+	tlsConn.ClientHelloMessage, err = readClientHello(br)
+	return tlsConn, err
+}
+
+// readProxy consumes a PROXY header from a trusted source and makes c report
+// the addresses it carries.
+func (s *sniffer) readProxy(c *sharedConn, br *bufio.Reader) error {
+	if !isTrusted(s.trusted, c.Conn.RemoteAddr()) {
+		return fmt.Errorf("PROXY header from untrusted source %v", c.Conn.RemoteAddr())
+	}
+
+	src, dst, err := readProxyHeader(br)
+	if err != nil {
+		return fmt.Errorf("invalid PROXY header from %v: %v", c.Conn.RemoteAddr(), err)
+	}
+
+	c.Lock()
+	c.vhostBuf.Next(c.vhostBuf.Len() - br.Buffered())
+	pc := &proxyConn{Conn: c.Conn, remote: src, local: dst}
+	pc.once.Do(func() {})
+	c.Conn = pc
+	c.Unlock()
+	return nil
+}
+
+func readSSHBanner(c *sharedConn, br *bufio.Reader) (Conn, error) {
+	var line []byte
+	for len(line) <= maxSSHBanner {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, sniffError{protoSSH, err}
+		}
+		if b == '\n' {
+			return &SSHConn{sharedConn: c, Banner: strings.TrimRight(string(line), "\r")}, nil
+		}
+		line = append(line, b)
+	}
+	return nil, sniffError{protoSSH, fmt.Errorf("banner longer than %d bytes", maxSSHBanner)}
+}
+
+// isHTTPMethodStart reports whether b can start an HTTP/1 request line.
+func isHTTPMethodStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+func readHTTPHost(c *sharedConn, br *bufio.Reader) (Conn, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, sniffError{protoHTTP, err}
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return &HTTPConn{sharedConn: c, host: host}, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newSniffingTestMuxer starts a muxer sniffing for the protocols in conf on a
+// loopback port, trusting PROXY headers from loopback addresses.
+func newSniffingTestMuxer(t *testing.T, conf Sniff) *TLSMuxer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := HandshakeLimits{}
+	if err := limits.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := parseCIDRs([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux, err := NewSniffingMuxer(l, limits, new(uint64), conf, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return mux
+}
+
+// sniffed sends data to mux and returns the connection accepted by l, along
+// with the first n bytes replayed from it.
+func sniffed(t *testing.T, mux *TLSMuxer, l net.Listener, data []byte, n int) (net.Conn, []byte) {
+	t.Helper()
+	c, err := net.Dial("tcp", mux.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Write(data)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	select {
+	case conn := <-accepted:
+		if conn == nil {
+			t.Fatal("listener closed")
+		}
+		t.Cleanup(func() { conn.Close() })
+		buf := make([]byte, n)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		return conn, buf
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not routed")
+	}
+	return nil, nil
+}
+
+func TestSniffHTTP(t *testing.T) {
+	mux := newSniffingTestMuxer(t, Sniff{HTTP: true})
+	l, err := mux.Listen("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := "GET / HTTP/1.1\r\nHost: Example.com:8080\r\n\r\n"
+	conn, got := sniffed(t, mux, l, []byte(req), len(req))
+	if string(got) != req {
+		t.Errorf("replayed %q, want %q", got, req)
+	}
+	if p := conn.(Conn).Protocol(); p != protoHTTP {
+		t.Errorf("protocol is %v, want %v", p, protoHTTP)
+	}
+}
+
+func TestSniffSSH(t *testing.T) {
+	mux := newSniffingTestMuxer(t, Sniff{SSH: true})
+	l, err := mux.Listen("ssh://")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	banner := "SSH-2.0-OpenSSH_9.6\r\n"
+	conn, got := sniffed(t, mux, l, []byte(banner), len(banner))
+	if string(got) != banner {
+		t.Errorf("replayed %q, want %q", got, banner)
+	}
+	if b := conn.(*SSHConn).Banner; b != "SSH-2.0-OpenSSH_9.6" {
+		t.Errorf("banner is %q", b)
+	}
+}
+
+func TestSniffOptionalProxyHeader(t *testing.T) {
+	mux := newSniffingTestMuxer(t, Sniff{Proxy: true})
+	l, err := mux.Listen("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := clientHelloRecord(tls.VersionTLS12, "example.com")
+	for _, header := range []string{"PROXY TCP4 192.0.2.1 192.0.2.2 4321 443\r\n", ""} {
+		conn, got := sniffed(t, mux, l, append([]byte(header), hello...), len(hello))
+		if string(got) != string(hello) {
+			t.Errorf("header %q: replayed bytes are not the ClientHello", header)
+		}
+		want := "127.0.0.1"
+		if header != "" {
+			want = "192.0.2.1"
+		}
+		if ip := addrIP(conn.RemoteAddr()); ip.String() != want {
+			t.Errorf("header %q: remote address is %v, want %v", header, ip, want)
+		}
+	}
+}
+
+func TestRuleKeepsToItsProtocol(t *testing.T) {
+	mux := newSniffingTestMuxer(t, Sniff{HTTP: true})
+	web, err := mux.Listen("http://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := mux.Listen("tls.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a rule without conditions takes every TLS client, but no HTTP one
+	rules, err := newRuleSet([]Rule{{Frontend: "tls.example.com"}}, map[string]*Frontend{
+		"tls.example.com": {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.SetRules(rules, map[string]*Listener{"tls.example.com": target.(*Listener)})
+
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	sniffed(t, mux, web, []byte(req), len(req))
+
+	hello := clientHelloRecord(tls.VersionTLS12, "other.example.com")
+	sniffed(t, mux, target, hello, len(hello))
+}
+
+func TestSniffedProxyHeaderChecked(t *testing.T) {
+	mux := newSniffingTestMuxer(t, Sniff{Proxy: true})
+	l, err := mux.Listen("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := newAccessList("global ACL", &ACL{Deny: []string{"192.0.2.66"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.SetACL("", acl)
+	mux.SetSourceRateLimit(newSourceRateLimiter(&RateLimit{Rate: 0.001, Burst: 1}))
+
+	hello := clientHelloRecord(tls.VersionTLS12, "example.com")
+	proxied := func(client string) []byte {
+		return append([]byte("PROXY TCP4 "+client+" 192.0.2.2 4321 443\r\n"), hello...)
+	}
+
+	// the balancer's own address would have used up the only token
+	for _, client := range []string{"192.0.2.1", "192.0.2.3"} {
+		sniffed(t, mux, l, proxied(client), len(hello))
+	}
+
+	isOverloaded := func(err error) bool { _, ok := err.(Overloaded); return ok }
+	isForbidden := func(err error) bool { _, ok := err.(Forbidden); return ok }
+	for client, want := range map[string]func(error) bool{
+		"192.0.2.1":  isOverloaded,
+		"192.0.2.66": isForbidden,
+	} {
+		c, err := net.Dial("tcp", mux.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write(proxied(client))
+
+		conn, err := nextError(t, mux)
+		if !want(err) {
+			t.Errorf("%v was refused with %v", client, err)
+		}
+		if ip := addrIP(conn.RemoteAddr()); ip.String() != client {
+			t.Errorf("%v was refused as %v", client, ip)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHandshakeTimeout = 10000 // milliseconds
+)
+
+// activityClock records the last time data moved in either direction of a
+// session.
+type activityClock struct {
+	last int64
+}
+
+func newActivityClock() *activityClock {
+	return &activityClock{last: time.Now().UnixNano()}
+}
+
+func (c *activityClock) touch() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+func (c *activityClock) since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.last)))
+}
+
+// idleConn closes a session once neither side has sent anything for idle. It
+// refreshes the deadline before every read and write, so a connection that is
+// quiet in one direction survives as long as the other direction is busy.
+// Deadlines set by callers still apply on top.
+type idleConn struct {
+	net.Conn
+	idle  time.Duration
+	clock *activityClock
+
+	sync.Mutex
+	readCap  time.Time
+	writeCap time.Time
+}
+
+func (c *idleConn) deadline(cap time.Time) time.Time {
+	d := time.Now().Add(c.idle - c.clock.since())
+	if !cap.IsZero() && cap.Before(d) {
+		return cap
+	}
+	return d
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		c.Lock()
+		readCap := c.readCap
+		c.Unlock()
+
+		if err := c.Conn.SetReadDeadline(c.deadline(readCap)); err != nil {
+			return 0, err
+		}
+
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.clock.touch()
+		}
+		if n == 0 && isTimeout(err) && c.clock.since() < c.idle && (readCap.IsZero() || time.Now().Before(readCap)) {
+			// the other direction kept the session alive
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write gives up on the first timeout: a timed out write may have sent part
+// of a TLS record, and tls.Conn refuses every write after it. The deadline is
+// pushed out before each write instead, from whatever the session last did.
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Lock()
+	writeCap := c.writeCap
+	c.Unlock()
+
+	if err := c.Conn.SetWriteDeadline(c.deadline(writeCap)); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.clock.touch()
+	}
+	return n, err
+}
+
+// SetDeadline caps both deadlines. Like the other setters it also moves the
+// underlying deadline, so the cap reaches a Read or Write that is blocked.
+func (c *idleConn) SetDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.readCap, c.writeCap = t, t
+	return c.Conn.SetDeadline(c.deadline(t))
+}
+
+func (c *idleConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.readCap = t
+	return c.Conn.SetReadDeadline(c.deadline(t))
+}
+
+func (c *idleConn) SetWriteDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+	c.writeCap = t
+	return c.Conn.SetWriteDeadline(c.deadline(t))
+}
+
+func (c *idleConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// tcpConnOf returns the TCP connection underneath every wrapper around c, or
+// nil. Unlike rawConn it does not care whether the wrappers are still needed.
+func tcpConnOf(c net.Conn) *net.TCPConn {
+	for {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn
+		case *TLSConn:
+			c = conn.sharedConn.Conn
+		case *HTTPConn:
+			c = conn.sharedConn.Conn
+		case *SSHConn:
+			c = conn.sharedConn.Conn
+		case *handshakeConn:
+			c = conn.Conn
+		case *proxyConn:
+			c = conn.Conn
+		case *idleConn:
+			c = conn.Conn
+		case *tls.Conn:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// setKeepAlive configures TCP keepalive on the connection underneath c. A
+// negative period disables it and zero keeps the system default.
+func setKeepAlive(c net.Conn, period time.Duration) {
+	tcpConn := tcpConnOf(c)
+	if tcpConn == nil || period == 0 {
+		return
+	}
+	if period < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	tcpConn.SetKeepAlivePeriod(period)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestIdleConnWriteTimeout(t *testing.T) {
+	client, server := tcpPair(t)
+	cert := newTestCA(t).issue(t, "", "example.com")
+	srv := tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}})
+	go srv.Handshake() // then never read again
+	c := tls.Client(client, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err := c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the other direction of the session stays busy throughout
+	clock := newActivityClock()
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case <-time.After(10 * time.Millisecond):
+				clock.touch()
+			}
+		}
+	}()
+
+	conn := &idleConn{Conn: c, idle: 100 * time.Millisecond, clock: clock}
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(make([]byte, 64<<20))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !isTimeout(err) {
+			t.Errorf("write to a stalled peer failed with %v, want a timeout", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("write to a stalled peer did not give up")
+	}
+}
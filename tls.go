@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strconv"
@@ -90,10 +90,18 @@ const (
 
 	alertUnexpectedMessage alert = 10
 	alertRecordOverflow    alert = 22
+	alertHandshakeFailure  alert = 40
+	alertAccessDenied      alert = 49
+	alertDecodeError       alert = 50
+	alertProtocolVersion   alert = 70
 	alertInternalError     alert = 80
+	alertUnrecognizedName  alert = 112
 
+	recordTypeAlert     recordType = 21
 	recordTypeHandshake recordType = 22
 
+	alertLevelError uint8 = 2
+
 	typeClientHello uint8 = 1
 
 	statusTypeOCSP uint8 = 1
@@ -102,7 +110,12 @@ const (
 var alertText = map[alert]string{
 	alertUnexpectedMessage: "unexpected message",
 	alertRecordOverflow:    "record overflow",
+	alertHandshakeFailure:  "handshake failure",
+	alertAccessDenied:      "access denied",
+	alertDecodeError:       "decode error",
+	alertProtocolVersion:   "protocol version not supported",
 	alertInternalError:     "internal error",
+	alertUnrecognizedName:  "unrecognized name",
 }
 
 var (
@@ -110,7 +123,9 @@ var (
 	extensionStatusRequest   uint16 = 5
 	extensionSupportedCurves uint16 = 10
 	extensionSupportedPoints uint16 = 11
+	extensionALPN            uint16 = 16
 	extensionSessionTicket   uint16 = 35
+	extensionSupportedVers   uint16 = 43
 	extensionNextProtoNeg    uint16 = 13172 // not IANA assigned
 )
 
@@ -140,6 +155,24 @@ type ClientHelloMessage struct {
 	SupportedPoints    []uint8
 	TicketSupported    bool
 	SessionTicket      []uint8
+	ALPNProtocols      []string
+	SupportedVersions  []uint16
+	Extensions         []uint16
+}
+
+// Version returns the highest TLS version offered by the client, taking the
+// supported_versions extension into account for TLS 1.3 clients.
+func (m *ClientHelloMessage) Version() uint16 {
+	vers := m.Vers
+	for _, v := range m.SupportedVersions {
+		if isGREASE(v) {
+			continue
+		}
+		if v > vers {
+			vers = v
+		}
+	}
+	return vers
 }
 
 type TLSConn struct {
@@ -154,10 +187,29 @@ func (c *TLSConn) Host() string {
 	return c.ClientHelloMessage.ServerName
 }
 
+func (c *TLSConn) Protocol() string {
+	return protoTLS
+}
+
 func (c *TLSConn) Free() {
 	c.ClientHelloMessage = nil
 }
 
+// writeAlert sends a fatal alert record in response to a ClientHello. TLS 1.3
+// clients still expect a TLS 1.2 record version.
+func writeAlert(w io.Writer, hello *ClientHelloMessage, a alert) error {
+	vers := uint16(0x0301)
+	if hello != nil && hello.Vers > vers {
+		vers = hello.Vers
+	}
+	if vers > 0x0303 {
+		vers = 0x0303
+	}
+
+	_, err := w.Write([]byte{byte(recordTypeAlert), byte(vers >> 8), byte(vers), 0, 2, alertLevelError, byte(a)})
+	return err
+}
+
 func TLS(conn net.Conn) (tlsConn *TLSConn, err error) {
 	c, rd := newSharedConn(conn)
 
@@ -195,7 +247,7 @@ func readClientHello(rd io.Reader) (*ClientHelloMessage, error) {
 		// is always < 256 bytes long. Therefore typ == 0x80 strongly suggests
 		// an SSLv2 client.
 		if typ == 0x80 {
-			return errors.New("tls: unsupported SSLv2 handshake received")
+			return fmt.Errorf("tls: unsupported SSLv2 handshake received: %w", alertProtocolVersion)
 		}
 
 		vers := uint16(b.data[1])<<8 | uint16(b.data[2])
@@ -233,8 +285,11 @@ func readClientHello(rd io.Reader) (*ClientHelloMessage, error) {
 		return nil
 	}
 
-	if err := readRecord(); err != nil {
-		return nil, err
+	// the handshake header itself may be split over records
+	for hand.Len() < 4 {
+		if err := readRecord(); err != nil {
+			return nil, err
+		}
 	}
 
 	data := hand.Bytes()
@@ -305,6 +360,9 @@ func (m *ClientHelloMessage) unmarshal(data []byte) bool {
 	m.OcspStapling = false
 	m.TicketSupported = false
 	m.SessionTicket = nil
+	m.ALPNProtocols = nil
+	m.SupportedVersions = nil
+	m.Extensions = nil
 
 	if len(data) == 0 {
 		// ClientHello is optionally followed by extension data
@@ -330,6 +388,7 @@ func (m *ClientHelloMessage) unmarshal(data []byte) bool {
 		if len(data) < length {
 			return false
 		}
+		m.Extensions = append(m.Extensions, extension)
 
 		switch extension {
 		case extensionServerName:
@@ -392,6 +451,39 @@ func (m *ClientHelloMessage) unmarshal(data []byte) bool {
 			// http://tools.ietf.org/html/rfc5077#section-3.2
 			m.TicketSupported = true
 			m.SessionTicket = data[:length]
+		case extensionALPN:
+			// http://tools.ietf.org/html/rfc7301#section-3.1
+			if length < 2 {
+				return false
+			}
+			l := int(data[0])<<8 | int(data[1])
+			if length != l+2 {
+				return false
+			}
+			d := data[2:length]
+			for len(d) != 0 {
+				protoLen := int(d[0])
+				if protoLen == 0 || len(d) < 1+protoLen {
+					return false
+				}
+				m.ALPNProtocols = append(m.ALPNProtocols, string(d[1:1+protoLen]))
+				d = d[1+protoLen:]
+			}
+		case extensionSupportedVers:
+			// http://tools.ietf.org/html/rfc8446#section-4.2.1
+			if length < 1 {
+				return false
+			}
+			l := int(data[0])
+			if l%2 == 1 || length != l+1 {
+				return false
+			}
+			m.SupportedVersions = make([]uint16, l/2)
+			d := data[1:]
+			for i := range m.SupportedVersions {
+				m.SupportedVersions[i] = uint16(d[0])<<8 | uint16(d[1])
+				d = d[2:]
+			}
 		}
 		data = data[length:]
 	}
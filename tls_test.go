@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// tlsClientHello returns the first record a crypto/tls client sends with
+// config.
+func tlsClientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, recordHeaderLen+(int(header[3])<<8|int(header[4])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[recordHeaderLen:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestReadClientHello(t *testing.T) {
+	record := tlsClientHello(t, &tls.Config{ServerName: "Example.com", NextProtos: []string{"h2", "http/1.1"}})
+
+	// the same handshake message spread over three records, splitting its
+	// header
+	hs := record[recordHeaderLen:]
+	var fragmented []byte
+	for _, part := range [][]byte{hs[:2], hs[2:100], hs[100:]} {
+		fragmented = append(fragmented, record[0], record[1], record[2], byte(len(part)>>8), byte(len(part)))
+		fragmented = append(fragmented, part...)
+	}
+
+	for name, b := range map[string][]byte{"single": record, "fragmented": fragmented} {
+		msg, err := readClientHello(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if msg.ServerName != "Example.com" {
+			t.Errorf("%v: server name is %q", name, msg.ServerName)
+		}
+		if len(msg.ALPNProtocols) != 2 || msg.ALPNProtocols[0] != "h2" {
+			t.Errorf("%v: ALPN is %v", name, msg.ALPNProtocols)
+		}
+		if msg.Version() != tls.VersionTLS13 {
+			t.Errorf("%v: version is %#04x", name, msg.Version())
+		}
+		if len(msg.JA3()) != 32 {
+			t.Errorf("%v: JA3 is %q", name, msg.JA3())
+		}
+	}
+}
+
+func TestReadClientHelloInvalid(t *testing.T) {
+	record := tlsClientHello(t, &tls.Config{ServerName: "example.com"})
+	notHandshake := append([]byte(nil), record...)
+	notHandshake[0] = byte(recordTypeAlert)
+
+	for name, b := range map[string][]byte{
+		"truncated":     record[:len(record)-1],
+		"not handshake": notHandshake,
+		"SSLv2":         {0x80, 0x2e, 0x01, 0x00, 0x02},
+		"HTTP":          []byte("GET / HTTP/1.1\r\n\r\n"),
+	} {
+		if _, err := readClientHello(bytes.NewReader(b)); err == nil {
+			t.Errorf("%v ClientHello was read", name)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	defaultTracingServiceName = "tlsmux"
+	tracerName                = "github.com/utahcon/tlsmux"
+)
+
+// Tracing exports spans for every proxied connection to an OTLP/HTTP
+// collector at Endpoint (host:port).
+type Tracing struct {
+	Endpoint    string  `yaml:"endpoint"`
+	Insecure    bool    `yaml:"insecure"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func (t *Tracing) setDefaults() error {
+	if t.ServiceName == "" {
+		t.ServiceName = defaultTracingServiceName
+	}
+	if t.SampleRatio == 0 {
+		t.SampleRatio = 1
+	}
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// newTracerProvider builds a provider exporting to exporter, or to the
+// configured OTLP endpoint when exporter is nil.
+func newTracerProvider(conf *Tracing, exporter sdktrace.SpanExporter) (*sdktrace.TracerProvider, error) {
+	if exporter == nil {
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Endpoint)}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+
+		var err error
+		if exporter, err = otlptracehttp.New(context.Background(), opts...); err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+		}
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(conf.ServiceName))),
+	), nil
+}
+
+func noopTracer() trace.Tracer {
+	return noop.NewTracerProvider().Tracer(tracerName)
+}
+
+// traceMuxer records the spans for the work Muxer.handle did before the
+// connection reached the server: reading the ClientHello and picking a
+// frontend. It returns the context of the connection's root span.
+func traceMuxer(tracer trace.Tracer, m *connMeta, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	start := time.Now()
+	if m != nil {
+		start = m.accepted
+	}
+
+	ctx, span := tracer.Start(context.Background(), "tlsmux.connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(attrs...))
+
+	if m != nil && !m.sniffed.IsZero() {
+		_, sniff := tracer.Start(ctx, "tlsmux.sniff", trace.WithTimestamp(m.accepted))
+		sniff.End(trace.WithTimestamp(m.sniffed))
+
+		routed := m.routed
+		if routed.IsZero() {
+			routed = time.Now()
+		}
+		_, route := tracer.Start(ctx, "tlsmux.route", trace.WithTimestamp(m.sniffed))
+		route.End(trace.WithTimestamp(routed))
+	}
+
+	return ctx, span
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingSpans(t *testing.T) {
+	backend := tlsEchoServer(t, "example.com")
+	exporter := tracetest.NewInMemoryExporter()
+	s := startServer(t, `
+port: 127.0.0.1:0
+tracing:
+  endpoint: 127.0.0.1:1
+frontends:
+  example.com:
+    backends:
+      - addr: %v
+`, func(s *Server) { s.spanExporter = exporter }, backend)
+
+	c, err := tls.Dial("tcp", s.addr(), &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	// the connection span ends once the server has seen both sides close
+	spans := make(map[string]tracetest.SpanStub)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.tracerProvider.ForceFlush(context.Background())
+		for _, span := range exporter.GetSpans() {
+			spans[span.Name] = span
+		}
+		if _, ok := spans["tlsmux.connection"]; ok {
+			break
+		}
+	}
+	root, ok := spans["tlsmux.connection"]
+	if !ok {
+		t.Fatalf("no connection span in %v", spanNames(exporter.GetSpans()))
+	}
+
+	want := map[attribute.Key]string{
+		"tlsmux.frontend": "example.com",
+		"tls.server_name": "example.com",
+		"tlsmux.backend":  backend,
+	}
+	for _, kv := range root.Attributes {
+		if v, ok := want[kv.Key]; ok && kv.Value.AsString() == v {
+			delete(want, kv.Key)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("connection span lacks attributes %v, has %v", want, root.Attributes)
+	}
+
+	for _, name := range []string{"tlsmux.sniff", "tlsmux.route", "tlsmux.dial", "tlsmux.session"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %v span", name)
+			continue
+		}
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("%v span is not a child of the connection span", name)
+		}
+	}
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	return names
+}
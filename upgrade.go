@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	envListenFDs = "TLSMUX_LISTEN_FDS" // name=fd pairs separated by commas
+	envReadyFD   = "TLSMUX_READY_FD"
+
+	upgradeTimeout = 30 * time.Second
+)
+
+// filer is implemented by the listeners whose file descriptors can be handed
+// to a new process.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// inheritedListeners returns the listeners and packet sockets passed down by
+// a parent during an upgrade, keyed by name.
+func inheritedListeners() (map[string]net.Listener, map[string]net.PacketConn, error) {
+	listeners := make(map[string]net.Listener)
+	packets := make(map[string]net.PacketConn)
+
+	env := os.Getenv(envListenFDs)
+	if env == "" {
+		return listeners, packets, nil
+	}
+
+	for _, pair := range strings.Split(env, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("malformed %v entry %q", envListenFDs, pair)
+		}
+
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed %v entry %q", envListenFDs, pair)
+		}
+
+		f := os.NewFile(uintptr(fd), parts[0])
+		l, err := net.FileListener(f)
+		if err != nil {
+			var pc net.PacketConn
+			if pc, err = net.FilePacketConn(f); err == nil {
+				packets[parts[0]] = pc
+			}
+		} else {
+			listeners[parts[0]] = l
+		}
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to inherit listener %v: %v", parts[0], err)
+		}
+	}
+
+	return listeners, packets, nil
+}
+
+// listen returns the listener a parent process handed down under name, or a
+// new one. Either way it is remembered so it can be handed on again.
+func (s *Server) listen(name, network, addr string) (net.Listener, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l, ok := s.inherited[name]
+	if ok {
+		delete(s.inherited, name)
+		s.Info("inherited listener", "name", name, "addr", l.Addr())
+	} else {
+		var err error
+		if l, err = listenSocket(network, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	s.remember(name, l)
+	return l, nil
+}
+
+// listenPacket is listen for packet sockets.
+func (s *Server) listenPacket(name, network, addr string) (net.PacketConn, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	pc, ok := s.inheritedPackets[name]
+	if ok {
+		delete(s.inheritedPackets, name)
+		s.Info("inherited listener", "name", name, "addr", pc.LocalAddr())
+	} else {
+		var err error
+		if pc, err = net.ListenPacket(network, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	s.remember(name, pc)
+	return pc, nil
+}
+
+// remember keeps a socket to hand on during an upgrade. s.lock must be held.
+func (s *Server) remember(name string, l io.Closer) {
+	if s.upgradable == nil {
+		s.upgradable = make(map[string]io.Closer)
+	}
+	s.upgradable[name] = l
+}
+
+// notifyReady tells the parent that started this process, if any, that it is
+// serving and the parent can drain.
+func (s *Server) notifyReady() {
+	env := os.Getenv(envReadyFD)
+	if env == "" {
+		return
+	}
+
+	fd, err := strconv.Atoi(env)
+	if err != nil {
+		s.Error("malformed ready fd", "fd", env)
+		return
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	if _, err = f.Write([]byte{1}); err != nil {
+		s.Error("failed to notify parent", "err", err)
+	}
+}
+
+// Upgrade starts a new copy of the executable, hands it every listener, and
+// shuts this process down once the copy reports it is ready. If the copy fails
+// to start in time it is killed and this process keeps serving.
+func (s *Server) Upgrade() error {
+	if !atomic.CompareAndSwapInt32(&s.upgrading, 0, 1) {
+		return fmt.Errorf("upgrade already in progress")
+	}
+	defer atomic.StoreInt32(&s.upgrading, 0)
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var fds []string
+	s.lock.Lock()
+	for name, l := range s.upgradable {
+		fl, ok := l.(filer)
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			s.lock.Unlock()
+			return fmt.Errorf("failed to get file for listener %v: %v", name, err)
+		}
+		if ul, ok := l.(*net.UnixListener); ok {
+			// the socket file now belongs to the new process too
+			ul.SetUnlinkOnClose(false)
+		}
+		fds = append(fds, fmt.Sprintf("%s=%d", name, 3+len(files)))
+		files = append(files, f)
+	}
+	s.lock.Unlock()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	env := []string{
+		envListenFDs + "=" + strings.Join(fds, ","),
+		fmt.Sprintf("%s=%d", envReadyFD, 3+len(files)),
+	}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envListenFDs+"=") && !strings.HasPrefix(kv, envReadyFD+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+	cmd.ExtraFiles = append(files, w)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start new process: %v", err)
+	}
+	s.Info("started new process", "pid", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := r.Read(buf)
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("timed out after %v", upgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("new process did not become ready: %v", err)
+	}
+
+	s.Info("new process is ready, draining", "pid", cmd.Process.Pid)
+	cmd.Process.Release()
+	s.Shutdown()
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	lf, err := l.(filer).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	pf, err := pc.(filer).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+
+	t.Setenv(envListenFDs, fmt.Sprintf("public=%v,quic=%v", lf.Fd(), pf.Fd()))
+	listeners, packets, err := inheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || len(packets) != 1 {
+		t.Fatalf("inherited %v listeners and %v packet sockets", len(listeners), len(packets))
+	}
+	defer listeners["public"].Close()
+	defer packets["quic"].Close()
+	if got := listeners["public"].Addr().String(); got != l.Addr().String() {
+		t.Errorf("inherited listener on %v, want %v", got, l.Addr())
+	}
+	if got := packets["quic"].LocalAddr().String(); got != pc.LocalAddr().String() {
+		t.Errorf("inherited packet socket on %v, want %v", got, pc.LocalAddr())
+	}
+}
+
+func TestInheritedListenersMalformed(t *testing.T) {
+	for _, env := range []string{"public", "public=x", "public=99999"} {
+		t.Setenv(envListenFDs, env)
+		if _, _, err := inheritedListeners(); err == nil {
+			t.Errorf("%q was accepted", env)
+		}
+	}
+
+	t.Setenv(envListenFDs, "")
+	listeners, packets, err := inheritedListeners()
+	if err != nil || len(listeners) != 0 || len(packets) != 0 {
+		t.Errorf("without %v, inherited %v and %v, %v", envListenFDs, listeners, packets, err)
+	}
+}
+
+func TestListenReusesInherited(t *testing.T) {
+	inherited, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+
+	s := &Server{
+		Logger:    newLogger(io.Discard, logFormatLogfmt, slog.LevelError),
+		inherited: map[string]net.Listener{"public": inherited},
+	}
+
+	// the inherited socket wins over the configured address
+	l, err := s.listen("public", "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l != inherited {
+		t.Errorf("listen opened %v instead of reusing %v", l.Addr(), inherited.Addr())
+	}
+	if _, ok := s.inherited["public"]; ok {
+		t.Error("inherited listener can be taken twice")
+	}
+
+	other, err := s.listen("internal", "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if other == inherited {
+		t.Error("listener without an inherited socket reused another's")
+	}
+
+	for _, name := range []string{"public", "internal"} {
+		if _, ok := s.upgradable[name]; !ok {
+			t.Errorf("listener %v would not be handed on", name)
+		}
+	}
+}